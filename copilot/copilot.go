@@ -5,14 +5,25 @@ package copilot
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"iter"
+	"log/slog"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	copilot "github.com/github/copilot-sdk/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"google.golang.org/adk/agent"
 	"google.golang.org/adk/memory"
 	"google.golang.org/adk/model"
@@ -25,7 +36,9 @@ import (
 type Config struct {
 	// CLIPath is the path to the Copilot CLI executable (default: "copilot" or COPILOT_CLI_PATH env)
 	CLIPath string
-	// CLIUrl is the URL of an existing CLI server (optional, e.g., "localhost:8080")
+	// CLIUrl is the URL of an existing CLI server (optional, e.g., "localhost:8080").
+	// It is mutually exclusive with CLIPath, and New returns an error if it is
+	// not a "port", "host:port" or "http(s)://host:port" address.
 	CLIUrl string
 	// Model is the model identifier (default: "gpt-4")
 	Model string
@@ -33,18 +46,160 @@ type Config struct {
 	Streaming bool
 	// LogLevel for the copilot client (default: "error")
 	LogLevel string
+	// Logger receives this package's own debug and warning logs, separate
+	// from the CLI's LogLevel (default: slog.Default())
+	Logger *slog.Logger
 	// Tools is a list of tools available to the LLM.
 	// Each tool must implement google.golang.org/adk/tool.Tool and provide
 	// a Declaration() method for schema and Run() method for execution.
 	Tools []tool.Tool
+	// Tracer records OpenTelemetry spans for client start, each request and
+	// each tool call (optional; spans are no-ops when nil)
+	Tracer trace.Tracer
+	// Metrics receives request latency, token usage and error counts, e.g.
+	// to export them to Prometheus (optional; a no-op when nil)
+	Metrics Metrics
+	// MaxParallelTools bounds how many tool calls from a single request run
+	// at once when the model requests several in one turn (default: 4)
+	MaxParallelTools int
+	// FailOnToolError aborts the request with the tool's error when a tool
+	// handler fails. By default the error is reported back to the model as
+	// the tool result so it can recover.
+	FailOnToolError bool
+	// ProxyURL is the HTTP proxy the spawned CLI process sends its traffic
+	// through (optional). When empty the CLI inherits HTTP_PROXY/HTTPS_PROXY
+	// from the environment. Not used with CLIUrl.
+	ProxyURL string
+	// RequestTimeout bounds the duration of each non-streaming GenerateContent
+	// call. Zero or negative means no timeout (the default). Streaming calls
+	// are never subject to it and rely on the caller's context for
+	// cancellation and StreamIdleTimeout instead.
+	RequestTimeout time.Duration
+	// StreamIdleTimeout aborts a streaming call when no session event arrives
+	// for this long, including while tools run (default: 0, disabled)
+	StreamIdleTimeout time.Duration
+	// StreamAccumulate makes each streamed partial response carry the full
+	// text of the current message so far instead of only the latest delta
+	// (the default). Thought parts accumulate the same way. The final
+	// response is unaffected. GenerateToWriter always uses deltas.
+	StreamAccumulate bool
+	// GuardContextWindow fails a request with ErrContextWindowExceeded,
+	// before anything is sent, when its estimated prompt size (see
+	// CountTokens) is above MaxInputTokens
+	GuardContextWindow bool
+	// MaxInputTokens is the prompt token limit used by GuardContextWindow and
+	// AutoTrimHistory (default: 128000). The SDK does not report per-model limits, so set
+	// it to match the model in use.
+	MaxInputTokens int
+	// AutoTrimHistory drops the oldest request contents until the estimated
+	// prompt, including the system instruction, fits MaxInputTokens, instead of sending (or, with
+	// GuardContextWindow, rejecting) an oversized request. System contents
+	// and the latest content are always kept, and a function call is never
+	// separated from its response. The number dropped is reported in
+	// MetadataTrimmedContents.
+	AutoTrimHistory bool
+	// EstimateUsageWhenMissing fills in UsageMetadata on the final response
+	// with a local estimate (the same one CountTokens uses) when Copilot
+	// reports no token usage for the turn. Estimated usage is marked with
+	// MetadataUsageEstimated. By default usage is left nil in that case.
+	EstimateUsageWhenMissing bool
+	// OnSessionEvent, if set, is called with every raw session event received
+	// from the CLI, including ones that produce no response, e.g. to capture
+	// the exact stream for debugging. It runs on the SDK's event goroutine
+	// and must not block.
+	OnSessionEvent func(copilot.SessionEvent)
+	// Provider routes completions to a custom OpenAI, Azure or Anthropic
+	// compatible endpoint (e.g. a local mock or proxy) instead of Copilot's
+	// own API. Optional; the CLI's Copilot backend is used when nil.
+	Provider *copilot.ProviderConfig
 }
 
+// ErrContextWindowExceeded is returned by GenerateContent when
+// Config.GuardContextWindow is set and the request's estimated prompt size is
+// above Config.MaxInputTokens.
+var ErrContextWindowExceeded = errors.New("request exceeds the model's context window")
+
+// requestIDKey is the context key for WithRequestID.
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying id as the request ID.
+// GenerateContent adds it to its log lines and trace span and returns it in
+// the final response's metadata under MetadataRequestID, so a request can be
+// correlated across systems together with its MetadataSessionID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID set by WithRequestID, or "".
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Metrics receives measurements from the completion path. Implementations
+// must be safe for concurrent use.
+type Metrics interface {
+	// ObserveLatency is called once per completed request with the
+	// requested model and the time from the call to its final response.
+	ObserveLatency(model string, d time.Duration)
+	// AddTokens is called with the token usage of each completed request
+	// that reports it.
+	AddTokens(prompt, completion int)
+	// IncError is called once per failure. kind is "timeout", "canceled",
+	// "tool" (a tool handler returned an error) or "request" (any other
+	// failure).
+	IncError(kind string)
+}
+
+// noopMetrics is the default Metrics and discards everything.
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveLatency(string, time.Duration) {}
+func (noopMetrics) AddTokens(int, int)                   {}
+func (noopMetrics) IncError(string)                      {}
+
+// Keys set in LLMResponse.CustomMetadata.
+const (
+	// MetadataModel holds the model that actually answered, as reported by
+	// Copilot; it may be more specific than the requested model.
+	MetadataModel = "model"
+	// MetadataMessageID holds the ID of the assistant message a response
+	// belongs to.
+	MetadataMessageID = "message_id"
+	// MetadataUsageEstimated is true when UsageMetadata was estimated
+	// locally because Copilot reported no usage (see
+	// Config.EstimateUsageWhenMissing).
+	MetadataUsageEstimated = "usage_estimated"
+	// MetadataTrimmedContents holds how many of the oldest request contents
+	// were dropped to fit the context window (see Config.AutoTrimHistory).
+	// It is set on the final response only when contents were dropped.
+	MetadataTrimmedContents = "trimmed_contents"
+	// MetadataRequestID holds the caller's request ID from WithRequestID,
+	// set on the final response when present.
+	MetadataRequestID = "request_id"
+	// MetadataSessionID holds the ID of the copilot session that served the
+	// request, which also appears in the CLI's logs. It is set on the final
+	// response.
+	MetadataSessionID = "session_id"
+)
+
 // CopilotLLM implements the model.LLM interface for GitHub Copilot.
 type CopilotLLM struct {
-	config  Config
-	client  *copilot.Client
-	started bool
+	config Config
+	client *copilot.Client
+	// state tracks whether client is running; it is shared with instances
+	// derived by WithModel
+	state *clientState
+	// toolsMu guards config.Tools, which can change after construction
+	toolsMu sync.RWMutex
+	// now returns the current time; tests override it
+	now func() time.Time
+}
+
+// clientState records whether a copilot client has been started.
+type clientState struct {
 	mu      sync.Mutex
+	started bool
 }
 
 // toolContext provides a minimal implementation of tool.Context for copilot-based tool execution.
@@ -153,7 +308,30 @@ func New(cfg Config) (*CopilotLLM, error) {
 	if cfg.LogLevel == "" {
 		cfg.LogLevel = "error"
 	}
-	if cfg.CLIPath == "" {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.Tracer == nil {
+		cfg.Tracer = noop.NewTracerProvider().Tracer("")
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = noopMetrics{}
+	}
+	if cfg.MaxInputTokens <= 0 {
+		cfg.MaxInputTokens = 128000
+	}
+	if cfg.MaxParallelTools <= 0 {
+		cfg.MaxParallelTools = 4
+	}
+	if cfg.CLIUrl != "" {
+		// Connecting to an existing server; there is no CLI to spawn
+		if cfg.CLIPath != "" {
+			return nil, fmt.Errorf("CLIPath and CLIUrl are mutually exclusive")
+		}
+		if err := validateCLIUrl(cfg.CLIUrl); err != nil {
+			return nil, err
+		}
+	} else if cfg.CLIPath == "" {
 		if envPath := os.Getenv("COPILOT_CLI_PATH"); envPath != "" {
 			cfg.CLIPath = envPath
 		} else {
@@ -164,22 +342,131 @@ func New(cfg Config) (*CopilotLLM, error) {
 	// Create client options
 	opts := &copilot.ClientOptions{
 		CLIPath:  cfg.CLIPath,
+		CLIUrl:   cfg.CLIUrl,
 		LogLevel: cfg.LogLevel,
 	}
-	if cfg.CLIUrl != "" {
-		opts.CLIUrl = cfg.CLIUrl
+	if cfg.ProxyURL != "" {
+		env, err := proxyEnv(os.Environ(), cfg.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		opts.Env = env
 	}
 
 	// Create the client (but don't start it yet - lazy start in GenerateContent)
 	client := copilot.NewClient(opts)
 
 	return &CopilotLLM{
-		config:  cfg,
-		client:  client,
-		started: false,
+		config: cfg,
+		client: client,
+		state:  &clientState{},
+		now:    time.Now,
 	}, nil
 }
 
+// Option configures a CopilotLLM created with NewWithOptions.
+type Option func(*Config)
+
+// NewWithOptions creates a new Copilot LLM instance from functional options.
+// It is equivalent to calling New with a Config that has the options applied,
+// and the same defaults fill in anything left unset.
+func NewWithOptions(opts ...Option) (*CopilotLLM, error) {
+	var cfg Config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return New(cfg)
+}
+
+// WithCLIPath sets Config.CLIPath.
+func WithCLIPath(path string) Option {
+	return func(cfg *Config) { cfg.CLIPath = path }
+}
+
+// WithCLIUrl sets Config.CLIUrl.
+func WithCLIUrl(url string) Option {
+	return func(cfg *Config) { cfg.CLIUrl = url }
+}
+
+// WithModel sets Config.Model.
+func WithModel(modelName string) Option {
+	return func(cfg *Config) { cfg.Model = modelName }
+}
+
+// WithStreaming sets Config.Streaming.
+func WithStreaming(streaming bool) Option {
+	return func(cfg *Config) { cfg.Streaming = streaming }
+}
+
+// WithLogLevel sets Config.LogLevel.
+func WithLogLevel(level string) Option {
+	return func(cfg *Config) { cfg.LogLevel = level }
+}
+
+// WithLogger sets Config.Logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(cfg *Config) { cfg.Logger = logger }
+}
+
+// WithTools appends tools to Config.Tools.
+func WithTools(tools ...tool.Tool) Option {
+	return func(cfg *Config) { cfg.Tools = append(cfg.Tools, tools...) }
+}
+
+// WithProvider sets Config.Provider.
+func WithProvider(provider *copilot.ProviderConfig) Option {
+	return func(cfg *Config) { cfg.Provider = provider }
+}
+
+// validateCLIUrl checks that cliURL has one of the forms the copilot SDK
+// accepts ("port", "host:port" or "http(s)://host:port"), so that a typo is
+// reported by New instead of causing a panic in the SDK.
+func validateCLIUrl(cliURL string) error {
+	// Like the SDK, strip at most one scheme
+	addr, found := strings.CutPrefix(cliURL, "http://")
+	if !found {
+		addr = strings.TrimPrefix(cliURL, "https://")
+	}
+	host, portStr, found := strings.Cut(addr, ":")
+	if !found {
+		host, portStr = "localhost", addr
+	}
+	if strings.ContainsAny(host, " \t/") {
+		return fmt.Errorf("invalid CLIUrl %q: host %q is not a valid hostname", cliURL, host)
+	}
+	// The SDK only accepts digits; Atoi alone would also allow a sign
+	port, err := strconv.Atoi(portStr)
+	if err != nil || strings.TrimLeft(portStr, "0123456789") != "" || port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid CLIUrl %q: expected \"port\", \"host:port\" or \"http://host:port\" with a port from 1 to 65535", cliURL)
+	}
+	return nil
+}
+
+// proxyEnv returns env with the proxy variables understood by the CLI set to
+// proxyURL, replacing any existing values.
+func proxyEnv(env []string, proxyURL string) ([]string, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q: %w", proxyURL, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: scheme and host are required", proxyURL)
+	}
+
+	proxyVars := []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"}
+	result := make([]string, 0, len(env)+len(proxyVars))
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if !slices.Contains(proxyVars, name) {
+			result = append(result, kv)
+		}
+	}
+	for _, name := range proxyVars {
+		result = append(result, name+"="+proxyURL)
+	}
+	return result, nil
+}
+
 // Name returns the name of this LLM implementation.
 func (c *CopilotLLM) Name() string {
 	return "github-copilot"
@@ -187,58 +474,194 @@ func (c *CopilotLLM) Name() string {
 
 // Close stops the copilot client gracefully.
 func (c *CopilotLLM) Close() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
 
-	if c.started && c.client != nil {
+	if c.state.started && c.client != nil {
 		c.client.Stop()
-		c.started = false
+		c.state.started = false
 	}
 	return nil
 }
 
+// WithModel returns a CopilotLLM that uses modelName as its default model and
+// otherwise shares c's configuration and CLI client, so no second CLI process
+// is started. The derived instance starts with c's currently registered tools;
+// later RegisterTool and UnregisterTool calls affect only the instance they are
+// called on. Closing either instance stops the shared client.
+func (c *CopilotLLM) WithModel(modelName string) *CopilotLLM {
+	cfg := c.config
+	cfg.Model = modelName
+	cfg.Tools = c.currentTools()
+
+	return &CopilotLLM{
+		config: cfg,
+		client: c.client,
+		state:  c.state,
+		now:    c.now,
+	}
+}
+
+// RegisterTool makes t available to subsequent requests, replacing any
+// registered tool with the same name. Requests already in flight keep the
+// tools they started with.
+func (c *CopilotLLM) RegisterTool(t tool.Tool) {
+	c.toolsMu.Lock()
+	defer c.toolsMu.Unlock()
+
+	tools := make([]tool.Tool, 0, len(c.config.Tools)+1)
+	for _, existing := range c.config.Tools {
+		if existing.Name() != t.Name() {
+			tools = append(tools, existing)
+		}
+	}
+	c.config.Tools = append(tools, t)
+}
+
+// UnregisterTool removes the tool with the given name from subsequent
+// requests. It is a no-op if no such tool is registered.
+func (c *CopilotLLM) UnregisterTool(name string) {
+	c.toolsMu.Lock()
+	defer c.toolsMu.Unlock()
+
+	tools := make([]tool.Tool, 0, len(c.config.Tools))
+	for _, existing := range c.config.Tools {
+		if existing.Name() != name {
+			tools = append(tools, existing)
+		}
+	}
+	c.config.Tools = tools
+}
+
+// mergeTools returns registered with each of overrides added, replacing any
+// registered tool of the same name. registered is not modified.
+func mergeTools(registered, overrides []tool.Tool) []tool.Tool {
+	if len(overrides) == 0 {
+		return registered
+	}
+	merged := make([]tool.Tool, 0, len(registered)+len(overrides))
+	for _, t := range registered {
+		if !slices.ContainsFunc(overrides, func(o tool.Tool) bool { return o.Name() == t.Name() }) {
+			merged = append(merged, t)
+		}
+	}
+	return append(merged, overrides...)
+}
+
+// RegisteredTools returns the sorted names of the tools available to
+// subsequent requests.
+func (c *CopilotLLM) RegisteredTools() []string {
+	tools := c.currentTools()
+	names := make([]string, 0, len(tools))
+	for _, t := range tools {
+		names = append(names, t.Name())
+	}
+	slices.Sort(names)
+	return names
+}
+
+// currentTools returns the tools registered at the time of the call.
+// The returned slice must not be modified.
+func (c *CopilotLLM) currentTools() []tool.Tool {
+	c.toolsMu.RLock()
+	defer c.toolsMu.RUnlock()
+
+	return c.config.Tools
+}
+
 // ensureStarted ensures the client is started (lazy initialization).
-func (c *CopilotLLM) ensureStarted() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (c *CopilotLLM) ensureStarted(ctx context.Context) error {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
 
-	if c.started {
+	if c.state.started {
 		return nil
 	}
 
+	_, span := c.config.Tracer.Start(ctx, "copilot.start_client")
+	defer span.End()
+
+	c.config.Logger.Debug("starting copilot client", "cliPath", c.config.CLIPath, "cliUrl", c.config.CLIUrl)
 	if err := c.client.Start(); err != nil {
+		c.config.Logger.Warn("failed to start copilot client", "error", err)
+		recordSpanError(span, err)
 		return fmt.Errorf("failed to start copilot client: %w", err)
 	}
-	c.started = true
+	c.state.started = true
 	return nil
 }
 
 // GenerateContent implements the model.LLM interface's GenerateContent method.
 func (c *CopilotLLM) GenerateContent(ctx context.Context, req *model.LLMRequest, stream bool) iter.Seq2[*model.LLMResponse, error] {
+	return c.generate(ctx, req, stream, c.config.StreamAccumulate, nil)
+}
+
+// GenerateContentWithTools is like GenerateContent but also offers tools for
+// this request only. A request tool replaces a registered tool with the same
+// name, e.g. one closed over request-specific state; the registered tools are
+// not modified, so concurrent requests are unaffected.
+func (c *CopilotLLM) GenerateContentWithTools(ctx context.Context, req *model.LLMRequest, stream bool, tools []tool.Tool) iter.Seq2[*model.LLMResponse, error] {
+	return c.generate(ctx, req, stream, c.config.StreamAccumulate, tools)
+}
+
+// generate implements GenerateContent. When accumulate is set, streamed
+// partial responses carry the running text of the current message rather
+// than only the latest delta. requestTools override registered tools of the
+// same name.
+func (c *CopilotLLM) generate(ctx context.Context, req *model.LLMRequest, stream, accumulate bool, requestTools []tool.Tool) iter.Seq2[*model.LLMResponse, error] {
 	return func(yield func(*model.LLMResponse, error) bool) {
-		// Ensure client is started (lazy start)
-		if err := c.ensureStarted(); err != nil {
-			yield(nil, fmt.Errorf("failed to start client: %w", err))
+		modelName, streaming := c.resolveModel(req, stream)
+
+		ctx, span := c.config.Tracer.Start(ctx, "copilot.generate_content", trace.WithAttributes(
+			attribute.String("gen_ai.request.model", modelName),
+			attribute.Bool("copilot.stream", streaming),
+		))
+		defer span.End()
+		yield = traceYield(span, yield)
+		yield = metricsYield(c.config.Metrics, modelName, c.now, yield)
+
+		// Format the prompt from the request contents
+		if err := validateContents(req.Contents); err != nil {
+			yield(nil, err)
 			return
 		}
-
-		// Determine model to use
-		modelName := c.config.Model
-		if req.Model != "" {
-			modelName = req.Model
+		contents, trimmed := c.trimContents(req)
+		prompt := formatPrompt(contents)
+		promptTokens := estimateTokens(prompt) + estimateTokens(instructionText(req.Config))
+		if c.config.GuardContextWindow {
+			if err := c.checkContextWindow(promptTokens); err != nil {
+				yield(nil, err)
+				return
+			}
 		}
 
-		// Determine streaming mode
-		streaming := c.config.Streaming
-		if stream {
-			streaming = true
+		// Ensure client is started (lazy start)
+		if err := c.ensureStarted(ctx); err != nil {
+			yield(nil, fmt.Errorf("failed to start client: %w", err))
+			return
 		}
 
+		// Apply the per-request timeout, if any
+		ctx, cancel := c.requestContext(ctx, streaming)
+		defer cancel()
+
 		// Convert adk tools to copilot tools
 		var copilotTools []copilot.Tool
-		if len(c.config.Tools) > 0 {
+		toolErrCh := make(chan error, 1)
+		if tools := mergeTools(c.currentTools(), requestTools); len(tools) > 0 {
+			var onToolError func(error)
+			if c.config.FailOnToolError {
+				onToolError = func(err error) {
+					select {
+					case toolErrCh <- err:
+					default:
+						// Only the first failure is reported
+					}
+				}
+			}
+
 			var err error
-			copilotTools, err = c.convertAdkTools(ctx, c.config.Tools)
+			copilotTools, err = c.convertAdkTools(ctx, tools, onToolError)
 			if err != nil {
 				yield(nil, fmt.Errorf("failed to convert tools: %w", err))
 				return
@@ -246,116 +669,865 @@ func (c *CopilotLLM) GenerateContent(ctx context.Context, req *model.LLMRequest,
 		}
 
 		// Create a new session for this request
-		session, err := c.client.CreateSession(&copilot.SessionConfig{
-			Model:     modelName,
-			Streaming: streaming,
-			Tools:     copilotTools,
-		})
+		logger := c.config.Logger.With("model", modelName, "stream", streaming)
+		requestID := RequestIDFromContext(ctx)
+		if requestID != "" {
+			logger = logger.With("requestID", requestID)
+			span.SetAttributes(attribute.String("copilot.request_id", requestID))
+		}
+		logger.Debug("creating copilot session", "tools", len(copilotTools))
+		session, err := c.client.CreateSession(c.sessionConfig(req, modelName, streaming, copilotTools))
 		if err != nil {
+			logger.Warn("failed to create copilot session", "error", err)
 			yield(nil, fmt.Errorf("failed to create session: %w", err))
 			return
 		}
 		defer session.Destroy()
+		logger = logger.With("sessionID", session.SessionID)
+		span.SetAttributes(attribute.String("copilot.session_id", session.SessionID))
 
-		// Format the prompt from the request contents
-		prompt := formatPrompt(req.Contents)
+		warnUnsupportedConfig(logger, req.Config)
 
 		// Create channels to bridge event callbacks to iterator
 		// Use larger buffer to prevent blocking in the event callback goroutine
-		type eventResult struct {
-			response *model.LLMResponse
-			err      error
-			done     bool
-		}
 		eventCh := make(chan eventResult, 100)
+		// Terminal results get their own channel so a full eventCh cannot
+		// drop them. It holds the first error, or the final response and done.
+		finalCh := make(chan eventResult, 2)
+		handler := &eventHandler{
+			streaming:  streaming,
+			accumulate: accumulate,
+			trimmed:    trimmed,
+			requestID:  requestID,
+			sessionID:  session.SessionID,
+		}
+		if c.config.EstimateUsageWhenMissing {
+			handler.promptTokens = promptTokens
+		}
 
-		// Track if we've already received the final message to avoid duplicate TurnComplete
-		var receivedFinalMessage bool
+		// Activity markers are only needed to keep a stream idle timeout
+		// from firing while events that produce no response arrive
+		var idleTimeout time.Duration
+		var activity chan struct{}
+		if streaming && c.config.StreamIdleTimeout > 0 {
+			idleTimeout = c.config.StreamIdleTimeout
+			activity = make(chan struct{}, 1)
+		}
 
 		// Subscribe to session events
-		unsubscribe := session.On(func(event copilot.SessionEvent) {
-			switch event.Type {
-			case "assistant.message_delta":
-				// Streaming partial response
-				if streaming && event.Data.DeltaContent != nil {
-					resp := convertEventToResponse(event, true)
-					select {
-					case eventCh <- eventResult{response: resp}:
-					default:
-						// Drop if channel is full to prevent blocking
-					}
-				}
-			case "assistant.message":
-				// Final complete message
-				receivedFinalMessage = true
-				resp := convertEventToResponse(event, false)
-				select {
-				case eventCh <- eventResult{response: resp}:
-				default:
-					// Drop if channel is full to prevent blocking
-				}
-			case "session.idle":
-				// Turn is complete - only send if we haven't sent a final message
-				// (the final message already has TurnComplete: true)
-				if !receivedFinalMessage {
-					select {
-					case eventCh <- eventResult{done: true}:
-					default:
-					}
-				} else {
-					// Signal done without sending another TurnComplete response
-					select {
-					case eventCh <- eventResult{done: true}:
-					default:
-					}
-				}
-			case "session.error":
-				// Handle error events from the SDK
-				errMsg := "unknown error"
-				if event.Data.Content != nil {
-					errMsg = *event.Data.Content
-				}
-				select {
-				case eventCh <- eventResult{err: fmt.Errorf("session error: %s", errMsg)}:
-				default:
-				}
-			}
-		})
+		unsubscribe := session.On(c.eventCallback(handler, eventCh, finalCh, activity, logger))
 		defer unsubscribe()
 
 		// Send the message
+		logger.Debug("sending prompt", "contents", len(req.Contents), "promptBytes", len(prompt))
 		_, err = session.Send(copilot.MessageOptions{
 			Prompt: prompt,
 		})
 		if err != nil {
+			logger.Warn("failed to send prompt", "error", err)
 			yield(nil, fmt.Errorf("failed to send message: %w", err))
 			return
 		}
 
-		// Process events from the channel
-		for {
+		forwardEvents(ctx, session, eventCh, finalCh, activity, toolErrCh, idleTimeout, logger, yield)
+	}
+}
+
+// eventCallback returns the session event subscriber that passes each event
+// to OnSessionEvent and converts it with handler. The SDK calls it on the one
+// goroutine that serves every session of the client, so it never blocks:
+// terminal results (errors, final responses and done) go to finalCh, other
+// results go to eventCh, and results that do not fit are dropped. Events that
+// produce no result signal activity, when activity is non-nil, for the stream
+// idle timeout.
+func (c *CopilotLLM) eventCallback(handler *eventHandler, eventCh, finalCh chan<- eventResult, activity chan<- struct{}, logger *slog.Logger) copilot.SessionEventHandler {
+	return func(event copilot.SessionEvent) {
+		if c.config.OnSessionEvent != nil {
+			c.config.OnSessionEvent(event)
+		}
+		results := handler.handle(event)
+		if len(results) == 0 {
+			if activity != nil {
+				select {
+				case activity <- struct{}{}:
+				default:
+					// An activity signal is already pending
+				}
+			}
+			return
+		}
+		for _, result := range results {
+			if result.terminal() {
+				select {
+				case finalCh <- result:
+				default:
+					// finalCh already holds what ends the turn
+					logger.Debug("dropping session event result after the turn ended", "type", event.Type)
+				}
+				continue
+			}
 			select {
-			case <-ctx.Done():
-				yield(nil, ctx.Err())
+			case eventCh <- result:
+			default:
+				// Drop if channel is full to prevent blocking
+				logger.Debug("dropping session event result; consumer is not keeping up", "type", event.Type)
+			}
+		}
+	}
+}
+
+// resolveModel returns the model and streaming mode to use for req, applying
+// the configured defaults.
+func (c *CopilotLLM) resolveModel(req *model.LLMRequest, stream bool) (string, bool) {
+	modelName := c.config.Model
+	if req.Model != "" {
+		modelName = req.Model
+	}
+	return modelName, c.config.Streaming || stream
+}
+
+// RequestPreview is what GenerateContent would send to Copilot for a request.
+type RequestPreview struct {
+	// Session is the configuration the session would be created with. Tool
+	// handlers are left nil so the preview cannot run tools, and provider
+	// credentials are redacted.
+	Session *copilot.SessionConfig
+	// Message is the message that would be sent to the session.
+	Message copilot.MessageOptions
+}
+
+// BuildRequest returns the session configuration and message GenerateContent
+// would send for req, without starting the CLI or creating a session. It is
+// meant for logging and diffing the exact payload when reproducing errors.
+func (c *CopilotLLM) BuildRequest(req *model.LLMRequest, stream bool) (*RequestPreview, error) {
+	modelName, streaming := c.resolveModel(req, stream)
+	if err := validateContents(req.Contents); err != nil {
+		return nil, err
+	}
+
+	var copilotTools []copilot.Tool
+	if tools := c.currentTools(); len(tools) > 0 {
+		var err error
+		copilotTools, err = c.convertAdkTools(context.Background(), tools, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert tools: %w", err)
+		}
+		for i := range copilotTools {
+			copilotTools[i].Handler = nil
+		}
+	}
+
+	contents, _ := c.trimContents(req)
+	session := c.sessionConfig(req, modelName, streaming, copilotTools)
+	session.Provider = redactProvider(session.Provider)
+	return &RequestPreview{
+		Session: session,
+		Message: copilot.MessageOptions{Prompt: formatPrompt(contents)},
+	}, nil
+}
+
+// redactProvider returns a copy of provider with its credentials replaced,
+// so that previews can be logged without leaking them.
+func redactProvider(provider *copilot.ProviderConfig) *copilot.ProviderConfig {
+	if provider == nil {
+		return nil
+	}
+	redacted := *provider
+	if redacted.APIKey != "" {
+		redacted.APIKey = "REDACTED"
+	}
+	if redacted.BearerToken != "" {
+		redacted.BearerToken = "REDACTED"
+	}
+	if provider.Azure != nil {
+		azure := *provider.Azure
+		redacted.Azure = &azure
+	}
+	return &redacted
+}
+
+// BatchGenerate runs independent non-streaming requests with at most
+// concurrency in flight (at least one) and returns their aggregated responses
+// and errors positionally aligned with reqs. A failed request does not stop
+// the others; requests not yet started when ctx is done fail with ctx.Err().
+// All requests share the same CLI client.
+func (c *CopilotLLM) BatchGenerate(ctx context.Context, reqs []*model.LLMRequest, concurrency int) ([]*model.LLMResponse, []error) {
+	return runBatch(ctx, len(reqs), concurrency, func(ctx context.Context, i int) (*model.LLMResponse, error) {
+		// Deltas are needed for CollectStream even when StreamAccumulate is set
+		return CollectStream(c.generate(ctx, reqs[i], false, false, nil))
+	})
+}
+
+// runBatch calls generate for indexes 0..n-1 with bounded concurrency.
+func runBatch(ctx context.Context, n, concurrency int, generate func(context.Context, int) (*model.LLMResponse, error)) ([]*model.LLMResponse, []error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	responses := make([]*model.LLMResponse, n)
+	errs := make([]error, n)
+	slots := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			responses[i], errs[i] = generate(ctx, i)
+		}(i)
+	}
+	wg.Wait()
+
+	return responses, errs
+}
+
+// traceYield wraps yield so that errors and the terminal response's finish
+// reason, model and token counts are recorded on span.
+func traceYield(span trace.Span, yield func(*model.LLMResponse, error) bool) func(*model.LLMResponse, error) bool {
+	return func(resp *model.LLMResponse, err error) bool {
+		switch {
+		case err != nil:
+			recordSpanError(span, err)
+		case resp != nil && resp.TurnComplete:
+			if resp.FinishReason != "" {
+				span.SetAttributes(attribute.StringSlice("gen_ai.response.finish_reasons", []string{string(resp.FinishReason)}))
+			}
+			if m, ok := resp.CustomMetadata[MetadataModel].(string); ok {
+				span.SetAttributes(attribute.String("gen_ai.response.model", m))
+			}
+			if usage := resp.UsageMetadata; usage != nil {
+				span.SetAttributes(
+					attribute.Int("gen_ai.usage.input_tokens", int(usage.PromptTokenCount)),
+					attribute.Int("gen_ai.usage.output_tokens", int(usage.CandidatesTokenCount)),
+				)
+			}
+		}
+		return yield(resp, err)
+	}
+}
+
+// metricsYield wraps yield so that errors and the terminal response's latency
+// since the wrap, as measured by now, and token usage are reported to metrics.
+func metricsYield(metrics Metrics, modelName string, now func() time.Time, yield func(*model.LLMResponse, error) bool) func(*model.LLMResponse, error) bool {
+	start := now()
+	return func(resp *model.LLMResponse, err error) bool {
+		switch {
+		case err != nil:
+			// Tool failures are counted by the tool handler when they occur
+			if kind := errorKind(err); kind != "tool" {
+				metrics.IncError(kind)
+			}
+		case resp != nil && resp.TurnComplete:
+			metrics.ObserveLatency(modelName, now().Sub(start))
+			if usage := resp.UsageMetadata; usage != nil {
+				metrics.AddTokens(int(usage.PromptTokenCount), int(usage.CandidatesTokenCount))
+			}
+		}
+		return yield(resp, err)
+	}
+}
+
+// errorKind classifies a request error for Metrics.IncError.
+func errorKind(err error) string {
+	var te *toolError
+	switch {
+	case errors.As(err, &te):
+		return "tool"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "request"
+	}
+}
+
+// toolError is a tool handler failure that aborts a request under
+// FailOnToolError.
+type toolError struct {
+	name string
+	err  error
+}
+
+func (e *toolError) Error() string {
+	return fmt.Sprintf("tool %q failed: %v", e.name, e.err)
+}
+
+func (e *toolError) Unwrap() error { return e.err }
+
+// recordSpanError marks span as failed with err.
+func recordSpanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// aborter is the part of a copilot session needed to stop it early.
+type aborter interface {
+	Abort() error
+}
+
+// forwardEvents yields results from eventCh and finalCh until the turn is
+// done, an error occurs, ctx is done or the consumer stops. A result from
+// finalCh is acted on only after eventCh is drained, since the subscriber
+// queued those results first. When idleTimeout is positive and neither a
+// result nor an activity signal arrives within it, the session is aborted
+// with a timeout error.
+func forwardEvents(
+	ctx context.Context,
+	session aborter,
+	eventCh, finalCh <-chan eventResult,
+	activity <-chan struct{},
+	toolErrCh <-chan error,
+	idleTimeout time.Duration,
+	logger *slog.Logger,
+	yield func(*model.LLMResponse, error) bool,
+) {
+	abort := func() {
+		if err := session.Abort(); err != nil {
+			logger.Debug("failed to abort copilot session", "error", err)
+		}
+	}
+
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	// forward handles one result and reports whether to keep going
+	forward := func(result eventResult) bool {
+		if result.err != nil {
+			logger.Warn("copilot session failed", "error", result.err)
+			yield(nil, result.err)
+			return false
+		}
+		if result.done {
+			logger.Debug("copilot session idle")
+			// Done signal - just return, don't send another TurnComplete
+			// since the final assistant.message already has TurnComplete: true
+			return false
+		}
+		if result.response != nil {
+			return yield(result.response, nil)
+		}
+		return true
+	}
+
+	// Process events from the channel
+	for {
+		select {
+		case <-ctx.Done():
+			// Abort so the CLI stops generating instead of running to
+			// completion in the background before the session is destroyed
+			logger.Debug("request cancelled", "error", ctx.Err())
+			abort()
+			yield(nil, ctx.Err())
+			return
+		case <-idle:
+			logger.Warn("stream stalled", "idleTimeout", idleTimeout)
+			abort()
+			yield(nil, fmt.Errorf("no stream activity for %s: %w", idleTimeout, context.DeadlineExceeded))
+			return
+		case <-activity:
+			if idleTimer != nil {
+				idleTimer.Reset(idleTimeout)
+			}
+		case err := <-toolErrCh:
+			logger.Warn("aborting after tool failure", "error", err)
+			abort()
+			yield(nil, err)
+			return
+		case result := <-eventCh:
+			// Time spent in the consumer is not stream inactivity, so the
+			// timer is stopped while yielding and restarted afterwards
+			if idleTimer != nil {
+				idleTimer.Stop()
+			}
+			if !forward(result) {
 				return
-			case result := <-eventCh:
-				if result.err != nil {
-					yield(nil, result.err)
-					return
+			}
+			if idleTimer != nil {
+				idleTimer.Reset(idleTimeout)
+			}
+		case result := <-finalCh:
+			if idleTimer != nil {
+				idleTimer.Stop()
+			}
+			for drained := false; !drained; {
+				select {
+				case earlier := <-eventCh:
+					if !forward(earlier) {
+						return
+					}
+				default:
+					drained = true
 				}
-				if result.done {
-					// Done signal - just return, don't send another TurnComplete
-					// since the final assistant.message already has TurnComplete: true
-					return
+			}
+			if !forward(result) {
+				return
+			}
+			if idleTimer != nil {
+				idleTimer.Reset(idleTimeout)
+			}
+		}
+	}
+}
+
+// CountTokens returns an estimate of the number of prompt tokens req would use.
+// The copilot SDK exposes no token-counting endpoint, so this is a local
+// approximation of roughly four characters per token over the formatted
+// prompt and the system instruction; it does not vary by model, leaves out
+// the CLI's own instructions and may differ from the billed count.
+func (c *CopilotLLM) CountTokens(ctx context.Context, req *model.LLMRequest) (int32, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := validateContents(req.Contents); err != nil {
+		return 0, err
+	}
+	return estimateTokens(formatPrompt(req.Contents)) + estimateTokens(instructionText(req.Config)), nil
+}
+
+// checkContextWindow returns an error wrapping ErrContextWindowExceeded when
+// the estimated prompt tokens are above MaxInputTokens.
+func (c *CopilotLLM) checkContextWindow(tokens int32) error {
+	if int(tokens) > c.config.MaxInputTokens {
+		return fmt.Errorf("%w: estimated %d prompt tokens, limit is %d", ErrContextWindowExceeded, tokens, c.config.MaxInputTokens)
+	}
+	return nil
+}
+
+// estimateTokens approximates the token count of text at four characters per token.
+func estimateTokens(text string) int32 {
+	if text == "" {
+		return 0
+	}
+	return int32((utf8.RuneCountInString(text) + 3) / 4)
+}
+
+// warnUnsupportedConfig logs request settings that the copilot SDK cannot
+// apply, so that they are not silently assumed to take effect.
+func warnUnsupportedConfig(logger *slog.Logger, cfg *genai.GenerateContentConfig) {
+	if cfg == nil {
+		return
+	}
+	if len(cfg.SafetySettings) > 0 {
+		logger.Warn("ignoring safety settings; Copilot applies its own content moderation", "count", len(cfg.SafetySettings))
+	}
+	if cfg.MaxOutputTokens > 0 {
+		logger.Warn("ignoring max output tokens; the copilot SDK has no output token limit", "maxOutputTokens", cfg.MaxOutputTokens)
+	}
+}
+
+// requestContext derives the context for a single request, applying
+// RequestTimeout to non-streaming requests.
+func (c *CopilotLLM) requestContext(ctx context.Context, streaming bool) (context.Context, context.CancelFunc) {
+	if streaming || c.config.RequestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.config.RequestTimeout)
+}
+
+// sessionConfig builds the copilot session configuration for a single request.
+func (c *CopilotLLM) sessionConfig(req *model.LLMRequest, modelName string, streaming bool, tools []copilot.Tool) *copilot.SessionConfig {
+	return &copilot.SessionConfig{
+		Model:         modelName,
+		Streaming:     streaming,
+		Tools:         tools,
+		Provider:      c.config.Provider,
+		SystemMessage: systemMessage(req.Config),
+	}
+}
+
+// systemMessage maps the request's system instruction to a session system
+// message, appended to the CLI's own, rather than a "System:" line in the
+// prompt. It returns nil when there is no instruction.
+func systemMessage(cfg *genai.GenerateContentConfig) *copilot.SystemMessageConfig {
+	text := instructionText(cfg)
+	if text == "" {
+		return nil
+	}
+	return &copilot.SystemMessageConfig{Mode: "append", Content: text}
+}
+
+// instructionText returns the text of cfg's system instruction, if any.
+func instructionText(cfg *genai.GenerateContentConfig) string {
+	if cfg == nil {
+		return ""
+	}
+	return extractText(cfg.SystemInstruction)
+}
+
+// CollectStream drains a GenerateContent iterator and returns a single
+// aggregated response. Partial text is concatenated unless a complete
+// (non-partial) response supersedes it, and the finish reason, usage and
+// metadata of the terminal response are carried through. The first error
+// encountered is returned with a nil response. Partial responses are expected
+// to be deltas, so streams from a model with StreamAccumulate set repeat text.
+func CollectStream(seq iter.Seq2[*model.LLMResponse, error]) (*model.LLMResponse, error) {
+	result := &model.LLMResponse{TurnComplete: true}
+	var text, thought strings.Builder
+
+	for resp, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		if resp == nil {
+			continue
+		}
+
+		if resp.Content != nil {
+			if resp.Partial {
+				for _, part := range resp.Content.Parts {
+					if part.Thought {
+						thought.WriteString(part.Text)
+					} else {
+						text.WriteString(part.Text)
+					}
 				}
-				if result.response != nil {
-					if !yield(result.response, nil) {
-						return
+			} else {
+				// A complete message replaces the deltas that preceded it
+				result.Content = resp.Content
+				text.Reset()
+				thought.Reset()
+			}
+		}
+
+		if resp.TurnComplete {
+			result.FinishReason = resp.FinishReason
+			result.UsageMetadata = resp.UsageMetadata
+			result.CustomMetadata = resp.CustomMetadata
+			result.ErrorCode = resp.ErrorCode
+			result.ErrorMessage = resp.ErrorMessage
+			break
+		}
+	}
+
+	if text.Len() > 0 || thought.Len() > 0 {
+		content := &genai.Content{Role: "model"}
+		if thought.Len() > 0 {
+			content.Parts = append(content.Parts, &genai.Part{Text: thought.String(), Thought: true})
+		}
+		if text.Len() > 0 {
+			content.Parts = append(content.Parts, genai.NewPartFromText(text.String()))
+		}
+		result.Content = content
+	}
+
+	return result, nil
+}
+
+// GenerateToWriter streams the response to req, writing answer text to w as
+// it arrives, and returns the aggregated response as CollectStream would.
+// Thought parts are not written. If w has a Flush method it is called after
+// each write so output appears promptly.
+func (c *CopilotLLM) GenerateToWriter(ctx context.Context, req *model.LLMRequest, w io.Writer) (*model.LLMResponse, error) {
+	// Deltas are needed to write each piece of text exactly once
+	return CollectStream(teeToWriter(c.generate(ctx, req, true, false, nil), w))
+}
+
+// teeToWriter wraps seq so that answer text is written to w as responses
+// pass through. A complete response only adds what its deltas did not write,
+// so text is not written twice and deltas dropped under load are not lost.
+func teeToWriter(seq iter.Seq2[*model.LLMResponse, error], w io.Writer) iter.Seq2[*model.LLMResponse, error] {
+	return func(yield func(*model.LLMResponse, error) bool) {
+		// written is the text of the current message written so far
+		var written strings.Builder
+		for resp, err := range seq {
+			if err == nil && resp != nil && resp.Content != nil {
+				text := answerText(resp.Content)
+				if resp.Partial {
+					written.WriteString(text)
+				} else {
+					if rest, ok := strings.CutPrefix(text, written.String()); ok {
+						text = rest
 					}
+					written.Reset()
 				}
+				if werr := writeText(w, text); werr != nil {
+					yield(nil, fmt.Errorf("failed to write response: %w", werr))
+					return
+				}
+			}
+			if !yield(resp, err) {
+				return
+			}
+		}
+	}
+}
+
+// answerText returns the non-thought text of content.
+func answerText(content *genai.Content) string {
+	var text strings.Builder
+	for _, part := range content.Parts {
+		if !part.Thought {
+			text.WriteString(part.Text)
+		}
+	}
+	return text.String()
+}
+
+// writeText writes text, if any, to w and flushes it.
+func writeText(w io.Writer, text string) error {
+	if text == "" {
+		return nil
+	}
+	if _, err := io.WriteString(w, text); err != nil {
+		return err
+	}
+
+	switch f := w.(type) {
+	case interface{ Flush() error }:
+		return f.Flush()
+	case interface{ Flush() }:
+		f.Flush()
+	}
+	return nil
+}
+
+// eventResult bridges a session event callback to the GenerateContent iterator.
+type eventResult struct {
+	response *model.LLMResponse
+	err      error
+	done     bool
+}
+
+// terminal reports whether r ends the stream or carries its final response,
+// so must not be dropped.
+func (r eventResult) terminal() bool {
+	return r.err != nil || r.done || (r.response != nil && r.response.TurnComplete)
+}
+
+// eventHandler translates copilot session events into iterator results.
+// It is only used from the session's event dispatch goroutine.
+type eventHandler struct {
+	streaming bool
+	// accumulate makes partial responses carry text and thought so far,
+	// held in text and thought until the message completes.
+	accumulate bool
+	text       string
+	thought    string
+	// pending holds the latest final message until the session goes idle, so
+	// that usage reported after the message can still be attached to it.
+	pending *model.LLMResponse
+	usage   *genai.GenerateContentResponseUsageMetadata
+	// reasoning holds the model's complete reasoning until the message it
+	// belongs to arrives.
+	reasoning string
+	// completed records that a terminal response has been emitted.
+	completed bool
+	// model is the model reported by the most recent usage event.
+	model string
+	// trimmed is the number of history contents dropped by AutoTrimHistory.
+	trimmed int
+	// requestID and sessionID identify the request for correlation.
+	requestID string
+	sessionID string
+	// promptTokens, when positive, is the estimated prompt size used to
+	// estimate usage if the turn reports none.
+	promptTokens int32
+}
+
+// handle converts a single session event into zero or more results.
+func (h *eventHandler) handle(event copilot.SessionEvent) []eventResult {
+	var results []eventResult
+
+	switch event.Type {
+	case "assistant.message_delta":
+		// Streaming partial response
+		if h.streaming && event.Data.DeltaContent != nil {
+			resp := convertEventToResponse(event, true)
+			if h.accumulate {
+				h.text += *event.Data.DeltaContent
+				resp.Content = &genai.Content{Role: "model", Parts: []*genai.Part{genai.NewPartFromText(h.text)}}
+			}
+			setMessageID(resp, event)
+			results = append(results, eventResult{response: resp})
+		}
+	case "assistant.reasoning_delta":
+		// Streaming partial reasoning, surfaced as a thought part
+		if h.streaming && event.Data.DeltaContent != nil && *event.Data.DeltaContent != "" {
+			thought := *event.Data.DeltaContent
+			if h.accumulate {
+				h.thought += thought
+				thought = h.thought
+			}
+			results = append(results, eventResult{response: &model.LLMResponse{
+				Content: &genai.Content{
+					Role:  "model",
+					Parts: []*genai.Part{{Text: thought, Thought: true}},
+				},
+				Partial: true,
+			}})
+		}
+	case "assistant.reasoning":
+		// Complete reasoning; attached to the next final message
+		if event.Data.Content != nil {
+			h.reasoning += *event.Data.Content
+		}
+	case "assistant.message":
+		// Complete message. A previous final message in the same turn is
+		// flushed as a non-terminal response, since this one supersedes it.
+		if h.pending != nil {
+			h.pending.TurnComplete = false
+			h.pending.FinishReason = genai.FinishReasonUnspecified
+			results = append(results, eventResult{response: h.pending})
+			h.pending = nil
+		}
+		resp := convertEventToResponse(event, false)
+		setMessageID(resp, event)
+		h.text, h.thought = "", ""
+		if h.reasoning != "" {
+			addThought(resp, h.reasoning)
+			h.reasoning = ""
+		}
+		if len(event.Data.ToolRequests) > 0 {
+			// The model stopped to call tools. The SDK runs them and continues
+			// the turn, so this is not the final answer: emit any preamble as
+			// a non-terminal response and keep waiting.
+			resp.TurnComplete = false
+			resp.FinishReason = genai.FinishReasonUnspecified
+			if resp.Content != nil {
+				results = append(results, eventResult{response: resp})
 			}
+			break
+		}
+		h.pending = resp
+	case "assistant.usage":
+		// Token usage is reported once per model call; sum across the turn
+		h.usage = addUsage(h.usage, event)
+		if event.Data.Model != nil && *event.Data.Model != "" {
+			h.model = *event.Data.Model
+		}
+	case "session.idle":
+		// Turn is complete - emit the held final message (which already has
+		// TurnComplete: true) with the accumulated usage, then signal done
+		if h.pending != nil {
+			h.pending.UsageMetadata = h.usage
+			h.estimateUsage(h.pending)
+			h.setTurnMetadata(h.pending)
+			results = append(results, eventResult{response: h.pending})
+			h.pending = nil
+			h.completed = true
+		}
+		if !h.completed {
+			// The turn ended without a final message (e.g. the prompt was
+			// moderated); report that explicitly rather than ending silently
+			resp := &model.LLMResponse{
+				TurnComplete:  true,
+				FinishReason:  genai.FinishReasonOther,
+				ErrorMessage:  "model returned no response",
+				UsageMetadata: h.usage,
+			}
+			h.setTurnMetadata(resp)
+			results = append(results, eventResult{response: resp})
+			h.completed = true
+		}
+		results = append(results, eventResult{done: true})
+	case "session.error":
+		// Handle error events from the SDK
+		errMsg := "unknown error"
+		if event.Data.Content != nil {
+			errMsg = *event.Data.Content
+		}
+		results = append(results, eventResult{err: fmt.Errorf("session error: %s", errMsg)})
+	}
+
+	return results
+}
+
+// estimateUsage fills in resp's usage from the prompt and response text when
+// estimation is enabled and the turn reported no usage, marking it as
+// estimated in resp's metadata.
+func (h *eventHandler) estimateUsage(resp *model.LLMResponse) {
+	if h.promptTokens <= 0 || resp.UsageMetadata != nil {
+		return
+	}
+	var completion int32
+	if resp.Content != nil {
+		for _, part := range resp.Content.Parts {
+			completion += estimateTokens(part.Text)
 		}
 	}
+	prompt := h.promptTokens
+	resp.UsageMetadata = &genai.GenerateContentResponseUsageMetadata{
+		PromptTokenCount:     prompt,
+		CandidatesTokenCount: completion,
+		TotalTokenCount:      prompt + completion,
+	}
+	setMetadata(resp, MetadataUsageEstimated, true)
+}
+
+// setTurnMetadata records the reporting model, the number of trimmed history
+// contents and the request and session IDs, where known, on the terminal
+// response's metadata.
+func (h *eventHandler) setTurnMetadata(resp *model.LLMResponse) {
+	if h.model != "" {
+		setMetadata(resp, MetadataModel, h.model)
+	}
+	if h.trimmed > 0 {
+		setMetadata(resp, MetadataTrimmedContents, h.trimmed)
+	}
+	if h.requestID != "" {
+		setMetadata(resp, MetadataRequestID, h.requestID)
+	}
+	if h.sessionID != "" {
+		setMetadata(resp, MetadataSessionID, h.sessionID)
+	}
+}
+
+// setMessageID records the event's message ID on resp's metadata, if present.
+func setMessageID(resp *model.LLMResponse, event copilot.SessionEvent) {
+	if event.Data.MessageID != nil && *event.Data.MessageID != "" {
+		setMetadata(resp, MetadataMessageID, *event.Data.MessageID)
+	}
+}
+
+// setMetadata sets key in resp.CustomMetadata, allocating it on first use.
+func setMetadata(resp *model.LLMResponse, key string, value any) {
+	if resp.CustomMetadata == nil {
+		resp.CustomMetadata = make(map[string]any)
+	}
+	resp.CustomMetadata[key] = value
+}
+
+// addThought prepends the model's reasoning to resp as a thought part.
+func addThought(resp *model.LLMResponse, reasoning string) {
+	thought := &genai.Part{Text: reasoning, Thought: true}
+	if resp.Content == nil {
+		resp.Content = &genai.Content{Role: "model"}
+	}
+	resp.Content.Parts = append([]*genai.Part{thought}, resp.Content.Parts...)
+}
+
+// addUsage adds the token counts of an assistant.usage event to usage,
+// allocating it on first use.
+func addUsage(usage *genai.GenerateContentResponseUsageMetadata, event copilot.SessionEvent) *genai.GenerateContentResponseUsageMetadata {
+	if usage == nil {
+		usage = &genai.GenerateContentResponseUsageMetadata{}
+	}
+	if event.Data.InputTokens != nil {
+		usage.PromptTokenCount += int32(*event.Data.InputTokens)
+	}
+	if event.Data.OutputTokens != nil {
+		usage.CandidatesTokenCount += int32(*event.Data.OutputTokens)
+	}
+	if event.Data.CacheReadTokens != nil {
+		// Prompt tokens served from the provider's prompt cache
+		usage.CachedContentTokenCount += int32(*event.Data.CacheReadTokens)
+	}
+	usage.TotalTokenCount = usage.PromptTokenCount + usage.CandidatesTokenCount
+	return usage
 }
 
 // formatPrompt converts the conversation history to a prompt string.
@@ -366,14 +1538,17 @@ func formatPrompt(contents []*genai.Content) string {
 
 	// If there's only one content, just extract its text
 	if len(contents) == 1 {
-		return extractText(contents[0])
+		return formatParts(contents[0])
 	}
 
 	// Format multi-turn conversation
 	var sb strings.Builder
 	for _, content := range contents {
 		role := strings.ToLower(content.Role)
-		text := extractText(content)
+		text := formatParts(content)
+		if isToolResult(content) {
+			role = "tool"
+		}
 
 		if text == "" {
 			continue
@@ -387,6 +1562,8 @@ func formatPrompt(contents []*genai.Content) string {
 			sb.WriteString("Assistant: ")
 		case "system":
 			sb.WriteString("System: ")
+		case "tool", "function":
+			sb.WriteString("Tool: ")
 		default:
 			sb.WriteString(role)
 			sb.WriteString(": ")
@@ -398,6 +1575,68 @@ func formatPrompt(contents []*genai.Content) string {
 	return strings.TrimSpace(sb.String())
 }
 
+// trimContents returns the request contents to format into the prompt and
+// how many were dropped, applying AutoTrimHistory if enabled. The system
+// instruction is sent alongside the prompt, so it counts against the limit.
+func (c *CopilotLLM) trimContents(req *model.LLMRequest) ([]*genai.Content, int) {
+	if !c.config.AutoTrimHistory {
+		return req.Contents, 0
+	}
+	return trimHistory(req.Contents, c.config.MaxInputTokens-int(estimateTokens(instructionText(req.Config))))
+}
+
+// trimHistory drops the oldest contents until the estimated prompt fits
+// maxTokens, returning the kept contents and how many were dropped. System
+// contents and the latest content are always kept, and a function response
+// is dropped together with the call before it, so the result may still be
+// above maxTokens.
+func trimHistory(contents []*genai.Content, maxTokens int) ([]*genai.Content, int) {
+	if int(estimateTokens(formatPrompt(contents))) <= maxTokens {
+		return contents, 0
+	}
+
+	// Group droppable contents so that tool results stay with their call
+	var groups [][]int
+	for i, content := range contents {
+		if content == nil || strings.EqualFold(content.Role, "system") {
+			continue
+		}
+		if hasFunctionResponse(content) && len(groups) > 0 {
+			groups[len(groups)-1] = append(groups[len(groups)-1], i)
+			continue
+		}
+		groups = append(groups, []int{i})
+	}
+
+	dropped := make(map[int]bool)
+	kept := contents
+	for _, group := range groups[:max(len(groups)-1, 0)] {
+		for _, i := range group {
+			dropped[i] = true
+		}
+		kept = make([]*genai.Content, 0, len(contents)-len(dropped))
+		for i, content := range contents {
+			if !dropped[i] {
+				kept = append(kept, content)
+			}
+		}
+		if int(estimateTokens(formatPrompt(kept))) <= maxTokens {
+			break
+		}
+	}
+	return kept, len(dropped)
+}
+
+// hasFunctionResponse reports whether content contains a function response part.
+func hasFunctionResponse(content *genai.Content) bool {
+	for _, part := range content.Parts {
+		if part.FunctionResponse != nil {
+			return true
+		}
+	}
+	return false
+}
+
 // extractText extracts text content from a genai.Content.
 func extractText(content *genai.Content) string {
 	if content == nil || len(content.Parts) == 0 {
@@ -414,6 +1653,112 @@ func extractText(content *genai.Content) string {
 	return strings.Join(texts, "\n")
 }
 
+// formatParts renders a content's parts as prompt text. Text parts are kept
+// verbatim and function calls and responses are rendered as tool call and
+// result lines, so that earlier tool use survives in the conversation history.
+func formatParts(content *genai.Content) string {
+	if content == nil || len(content.Parts) == 0 {
+		return ""
+	}
+
+	var texts []string
+	for _, part := range content.Parts {
+		switch {
+		case part.Thought:
+			// Earlier reasoning is not replayed to the model
+		case part.Text != "":
+			texts = append(texts, part.Text)
+		case part.ExecutableCode != nil:
+			texts = append(texts, formatExecutableCode(part.ExecutableCode))
+		case part.CodeExecutionResult != nil:
+			texts = append(texts, formatCodeExecutionResult(part.CodeExecutionResult))
+		case part.FunctionCall != nil:
+			texts = append(texts, formatFunctionCall(part.FunctionCall))
+		case part.FunctionResponse != nil:
+			texts = append(texts, formatFunctionResponse(part.FunctionResponse))
+		}
+	}
+
+	return strings.Join(texts, "\n")
+}
+
+// formatFunctionCall renders a function call as a tool call line.
+func formatFunctionCall(fc *genai.FunctionCall) string {
+	args, err := json.Marshal(fc.Args)
+	if err != nil {
+		args = []byte(fmt.Sprintf("%v", fc.Args))
+	}
+
+	if fc.ID != "" {
+		return fmt.Sprintf("Called %s (call %s) with %s", fc.Name, fc.ID, args)
+	}
+	return fmt.Sprintf("Called %s with %s", fc.Name, args)
+}
+
+// formatFunctionResponse renders a function response as a tool result line.
+func formatFunctionResponse(fr *genai.FunctionResponse) string {
+	response, err := json.Marshal(fr.Response)
+	if err != nil {
+		response = []byte(fmt.Sprintf("%v", fr.Response))
+	}
+
+	if fr.ID != "" {
+		return fmt.Sprintf("Result of %s (call %s): %s", fr.Name, fr.ID, response)
+	}
+	return fmt.Sprintf("Result of %s: %s", fr.Name, response)
+}
+
+// formatExecutableCode renders model-generated code as a fenced block.
+func formatExecutableCode(code *genai.ExecutableCode) string {
+	lang := ""
+	if code.Language != "" && code.Language != genai.LanguageUnspecified {
+		lang = strings.ToLower(string(code.Language))
+	}
+	return fmt.Sprintf("```%s\n%s\n```", lang, code.Code)
+}
+
+// formatCodeExecutionResult renders the outcome and output of executed code.
+func formatCodeExecutionResult(result *genai.CodeExecutionResult) string {
+	if result.Outcome == "" {
+		return fmt.Sprintf("Code execution result: %s", result.Output)
+	}
+	return fmt.Sprintf("Code execution result (%s): %s", result.Outcome, result.Output)
+}
+
+// validateContents returns an error for parts the prompt cannot represent.
+// The copilot SDK accepts only a text prompt, so inline and file data would
+// otherwise be silently dropped from the request.
+func validateContents(contents []*genai.Content) error {
+	for i, content := range contents {
+		if content == nil {
+			continue
+		}
+		for _, part := range content.Parts {
+			switch {
+			case part.InlineData != nil:
+				return fmt.Errorf("unsupported inline data part (%s) in content %d: the copilot SDK accepts text prompts only", part.InlineData.MIMEType, i)
+			case part.FileData != nil:
+				return fmt.Errorf("unsupported file data part (%s) in content %d: the copilot SDK accepts text prompts only", part.FileData.FileURI, i)
+			}
+		}
+	}
+	return nil
+}
+
+// isToolResult reports whether content consists only of function responses,
+// which genai sends under the "user" role.
+func isToolResult(content *genai.Content) bool {
+	if content == nil || len(content.Parts) == 0 {
+		return false
+	}
+	for _, part := range content.Parts {
+		if part.FunctionResponse == nil {
+			return false
+		}
+	}
+	return true
+}
+
 // convertEventToResponse converts a copilot session event to an LLMResponse.
 func convertEventToResponse(event copilot.SessionEvent, partial bool) *model.LLMResponse {
 	resp := &model.LLMResponse{
@@ -422,10 +1767,16 @@ func convertEventToResponse(event copilot.SessionEvent, partial bool) *model.LLM
 	}
 
 	var text string
-	if partial && event.Data.DeltaContent != nil {
-		text = *event.Data.DeltaContent
-	} else if !partial && event.Data.Content != nil {
-		text = *event.Data.Content
+	if partial {
+		if event.Data.DeltaContent != nil {
+			text = *event.Data.DeltaContent
+		}
+	} else {
+		// A complete message ends the turn even when it carries no text,
+		// e.g. after everything was streamed as deltas
+		if event.Data.Content != nil {
+			text = *event.Data.Content
+		}
 		resp.FinishReason = genai.FinishReasonStop
 	}
 
@@ -544,8 +1895,13 @@ func schemaToMap(schema *genai.Schema) map[string]interface{} {
 }
 
 // convertAdkTools converts adk tool.Tool instances to copilot.Tool instances.
-func (c *CopilotLLM) convertAdkTools(ctx context.Context, tools []tool.Tool) ([]copilot.Tool, error) {
+// Tool errors are always returned to the model as the tool result; when
+// onError is non-nil it is also called with each failure.
+func (c *CopilotLLM) convertAdkTools(ctx context.Context, tools []tool.Tool, onError func(error)) ([]copilot.Tool, error) {
 	copilotTools := make([]copilot.Tool, 0, len(tools))
+	// The SDK dispatches each tool call on its own goroutine; this limits how
+	// many of them run concurrently for the request
+	slots := make(chan struct{}, c.config.MaxParallelTools)
 
 	for _, t := range tools {
 		// Check if the tool implements the FunctionTool interface (Declaration and Run methods)
@@ -579,15 +1935,35 @@ func (c *CopilotLLM) convertAdkTools(ctx context.Context, tools []tool.Tool) ([]
 			Description: decl.Description,
 			Parameters:  params,
 			Handler: func(inv copilot.ToolInvocation) (copilot.ToolResult, error) {
+				select {
+				case slots <- struct{}{}:
+					defer func() { <-slots }()
+				case <-ctx.Done():
+					return copilot.ToolResult{
+						Error: ctx.Err().Error(),
+					}, nil
+				}
+
+				toolCtx, span := c.config.Tracer.Start(ctx, "copilot.tool", trace.WithAttributes(
+					attribute.String("gen_ai.tool.name", toolName),
+					attribute.String("gen_ai.tool.call.id", inv.ToolCallID),
+				))
+				defer span.End()
+
 				// Create minimal tool context
 				tc := &toolContext{
-					ctx:    ctx,
+					ctx:    toolCtx,
 					callID: inv.ToolCallID,
 				}
 
 				// Call the adk tool's Run method
 				result, err := toolRef.Run(tc, inv.Arguments)
 				if err != nil {
+					recordSpanError(span, err)
+					c.config.Metrics.IncError("tool")
+					if onError != nil {
+						onError(&toolError{name: toolName, err: err})
+					}
 					return copilot.ToolResult{
 						Error: err.Error(),
 					}, nil
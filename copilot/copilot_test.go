@@ -1,11 +1,27 @@
 package copilot
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
-
+	"time"
+
+	copilot "github.com/github/copilot-sdk/go"
+	"github.com/github/copilot-sdk/go/generated"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/adk/model"
 	"google.golang.org/adk/tool"
 	"google.golang.org/genai"
 )
@@ -35,6 +51,9 @@ func TestNew(t *testing.T) {
 		if llm.config.CLIPath != "copilot" {
 			t.Errorf("expected default CLIPath 'copilot', got %q", llm.config.CLIPath)
 		}
+		if llm.config.MaxParallelTools != 4 {
+			t.Errorf("expected default MaxParallelTools 4, got %d", llm.config.MaxParallelTools)
+		}
 	})
 
 	t.Run("COPILOT_CLI_PATH env var", func(t *testing.T) {
@@ -107,6 +126,29 @@ func TestNew(t *testing.T) {
 		}
 	})
 
+	t.Run("default logger", func(t *testing.T) {
+		llm, err := New(Config{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if llm.config.Logger != slog.Default() {
+			t.Error("expected default logger to be slog.Default()")
+		}
+	})
+
+	t.Run("custom logger", func(t *testing.T) {
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		llm, err := New(Config{Logger: logger})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if llm.config.Logger != logger {
+			t.Error("expected custom logger to be kept")
+		}
+	})
+
 	t.Run("streaming config", func(t *testing.T) {
 		llm, err := New(Config{
 			Streaming: true,
@@ -126,7 +168,7 @@ func TestNew(t *testing.T) {
 			t.Fatalf("unexpected error: %v", err)
 		}
 
-		if llm.started {
+		if llm.state.started {
 			t.Error("expected client to not be started initially")
 		}
 		if llm.client == nil {
@@ -135,556 +177,2940 @@ func TestNew(t *testing.T) {
 	})
 }
 
-func TestName(t *testing.T) {
-	llm, err := New(Config{})
+func TestNewWithOptions(t *testing.T) {
+	echo := &fakeTool{name: "echo"}
+	provider := &copilot.ProviderConfig{Type: "openai", BaseURL: "http://localhost:11434/v1"}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	llm, err := NewWithOptions(
+		WithCLIPath("/usr/local/bin/copilot"),
+		WithModel("gpt-4o"),
+		WithStreaming(true),
+		WithLogLevel("debug"),
+		WithLogger(logger),
+		WithTools(echo),
+		WithProvider(provider),
+	)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if llm.Name() != "github-copilot" {
-		t.Errorf("expected name 'github-copilot', got %q", llm.Name())
+	cfg := llm.config
+	if cfg.CLIPath != "/usr/local/bin/copilot" || cfg.Model != "gpt-4o" || !cfg.Streaming || cfg.LogLevel != "debug" {
+		t.Errorf("options not applied: %+v", cfg)
+	}
+	if cfg.Logger != logger || cfg.Provider != provider {
+		t.Error("expected logger and provider to be set")
+	}
+	if len(cfg.Tools) != 1 || cfg.Tools[0].Name() != "echo" {
+		t.Errorf("expected echo tool, got %v", cfg.Tools)
 	}
-}
 
-func TestFormatPrompt(t *testing.T) {
-	t.Run("empty contents", func(t *testing.T) {
-		result := formatPrompt(nil)
-		if result != "" {
-			t.Errorf("expected empty string for nil contents, got %q", result)
+	t.Run("defaults applied", func(t *testing.T) {
+		llm, err := NewWithOptions()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
-
-		result = formatPrompt([]*genai.Content{})
-		if result != "" {
-			t.Errorf("expected empty string for empty contents, got %q", result)
+		if llm.config.Model != "gpt-4" || llm.config.LogLevel != "error" {
+			t.Errorf("expected New defaults, got %+v", llm.config)
 		}
 	})
+}
 
-	t.Run("single content", func(t *testing.T) {
-		contents := []*genai.Content{
-			{
-				Role:  "user",
-				Parts: []*genai.Part{genai.NewPartFromText("Hello, world!")},
-			},
-		}
+func TestWithModel(t *testing.T) {
+	echo := &fakeTool{name: "echo"}
+	llm, err := New(Config{Model: "gpt-4o", Tools: []tool.Tool{echo}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 
-		result := formatPrompt(contents)
-		if result != "Hello, world!" {
-			t.Errorf("expected 'Hello, world!', got %q", result)
-		}
-	})
+	fast := llm.WithModel("gpt-4o-mini")
+	if fast.config.Model != "gpt-4o-mini" {
+		t.Errorf("expected derived model 'gpt-4o-mini', got %q", fast.config.Model)
+	}
+	if llm.config.Model != "gpt-4o" {
+		t.Errorf("expected original model unchanged, got %q", llm.config.Model)
+	}
+	if fast.client != llm.client || fast.state != llm.state {
+		t.Error("expected derived instance to share the client and its state")
+	}
 
-	t.Run("multi-turn conversation with user", func(t *testing.T) {
-		contents := []*genai.Content{
-			{
-				Role:  "user",
-				Parts: []*genai.Part{genai.NewPartFromText("Hello")},
-			},
-			{
-				Role:  "model",
-				Parts: []*genai.Part{genai.NewPartFromText("Hi there!")},
-			},
-		}
+	fast.state.mu.Lock()
+	fast.state.started = true
+	fast.state.mu.Unlock()
+	if !llm.state.started {
+		t.Error("expected started state to be shared, not copied")
+	}
+	llm.state.started = false
 
-		result := formatPrompt(contents)
-		expected := "User: Hello\n\nAssistant: Hi there!"
-		if result != expected {
-			t.Errorf("expected %q, got %q", expected, result)
-		}
-	})
+	fast.UnregisterTool("echo")
+	if len(fast.currentTools()) != 0 || len(llm.currentTools()) != 1 {
+		t.Errorf("expected tool registries to be independent, got %d and %d tools", len(fast.currentTools()), len(llm.currentTools()))
+	}
+}
 
-	t.Run("model role mapped to Assistant", func(t *testing.T) {
-		contents := []*genai.Content{
-			{
-				Role:  "user",
-				Parts: []*genai.Part{genai.NewPartFromText("Question")},
-			},
-			{
-				Role:  "model",
-				Parts: []*genai.Part{genai.NewPartFromText("Answer")},
-			},
-		}
+func TestValidateCLIUrl(t *testing.T) {
+	tests := []struct {
+		name    string
+		cliURL  string
+		wantErr bool
+	}{
+		{name: "port only", cliURL: "8080"},
+		{name: "host and port", cliURL: "localhost:8080"},
+		{name: "http URL", cliURL: "http://127.0.0.1:8080"},
+		{name: "https URL", cliURL: "https://copilot.internal:443"},
+		{name: "missing port", cliURL: "localhost", wantErr: true},
+		{name: "port out of range", cliURL: "localhost:70000", wantErr: true},
+		{name: "signed port", cliURL: "+8080", wantErr: true},
+		{name: "signed port with host", cliURL: "localhost:+8080", wantErr: true},
+		{name: "two schemes", cliURL: "http://https://localhost:8080", wantErr: true},
+		{name: "space in host", cliURL: "https:// company .com:8080", wantErr: true},
+		{name: "path after port", cliURL: "http://localhost:8080/", wantErr: true},
+	}
 
-		result := formatPrompt(contents)
-		expected := "User: Question\n\nAssistant: Answer"
-		if result != expected {
-			t.Errorf("expected %q, got %q", expected, result)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCLIUrl(tt.cliURL)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	t.Run("New reports invalid URL instead of panicking", func(t *testing.T) {
+		if _, err := New(Config{CLIUrl: "localhost"}); err == nil {
+			t.Error("expected error for invalid CLIUrl")
 		}
 	})
 
-	t.Run("assistant role", func(t *testing.T) {
-		contents := []*genai.Content{
-			{
-				Role:  "user",
-				Parts: []*genai.Part{genai.NewPartFromText("Question")},
-			},
-			{
-				Role:  "assistant",
-				Parts: []*genai.Part{genai.NewPartFromText("Answer")},
-			},
+	t.Run("New accepts CLIUrl without CLIPath", func(t *testing.T) {
+		llm, err := New(Config{CLIUrl: "localhost:8080"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if llm.config.CLIPath != "" {
+			t.Errorf("expected no CLIPath with CLIUrl, got %q", llm.config.CLIPath)
 		}
+	})
 
-		result := formatPrompt(contents)
-		expected := "User: Question\n\nAssistant: Answer"
-		if result != expected {
-			t.Errorf("expected %q, got %q", expected, result)
+	t.Run("New rejects CLIPath with CLIUrl", func(t *testing.T) {
+		if _, err := New(Config{CLIPath: "copilot", CLIUrl: "localhost:8080"}); err == nil {
+			t.Error("expected error for CLIPath with CLIUrl")
 		}
 	})
+}
 
-	t.Run("system role", func(t *testing.T) {
-		contents := []*genai.Content{
-			{
-				Role:  "system",
-				Parts: []*genai.Part{genai.NewPartFromText("You are helpful")},
-			},
-			{
-				Role:  "user",
-				Parts: []*genai.Part{genai.NewPartFromText("Hello")},
-			},
+func TestProxyEnv(t *testing.T) {
+	t.Run("sets proxy variables", func(t *testing.T) {
+		env, err := proxyEnv([]string{"PATH=/usr/bin", "HTTPS_PROXY=http://old:1"}, "http://proxy.corp:3128")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
 
-		result := formatPrompt(contents)
-		expected := "System: You are helpful\n\nUser: Hello"
-		if result != expected {
-			t.Errorf("expected %q, got %q", expected, result)
+		expected := []string{
+			"PATH=/usr/bin",
+			"HTTP_PROXY=http://proxy.corp:3128",
+			"HTTPS_PROXY=http://proxy.corp:3128",
+			"http_proxy=http://proxy.corp:3128",
+			"https_proxy=http://proxy.corp:3128",
+		}
+		if !reflect.DeepEqual(env, expected) {
+			t.Errorf("expected %v, got %v", expected, env)
 		}
 	})
 
-	t.Run("unknown role uses role name", func(t *testing.T) {
-		contents := []*genai.Content{
-			{
-				Role:  "custom",
-				Parts: []*genai.Part{genai.NewPartFromText("Custom message")},
-			},
-			{
-				Role:  "user",
-				Parts: []*genai.Part{genai.NewPartFromText("Hello")},
-			},
+	t.Run("invalid proxy URL", func(t *testing.T) {
+		for _, proxyURL := range []string{"proxy.corp:3128", "://bad", "http://"} {
+			if _, err := proxyEnv(nil, proxyURL); err == nil {
+				t.Errorf("expected error for %q", proxyURL)
+			}
 		}
+	})
 
-		result := formatPrompt(contents)
-		expected := "custom: Custom message\n\nUser: Hello"
-		if result != expected {
-			t.Errorf("expected %q, got %q", expected, result)
+	t.Run("New rejects invalid proxy URL", func(t *testing.T) {
+		if _, err := New(Config{ProxyURL: "not a url"}); err == nil {
+			t.Error("expected error from New")
 		}
 	})
+}
 
-	t.Run("skips empty content", func(t *testing.T) {
-		contents := []*genai.Content{
-			{
-				Role:  "user",
-				Parts: []*genai.Part{genai.NewPartFromText("Hello")},
-			},
-			{
-				Role:  "model",
-				Parts: []*genai.Part{}, // Empty parts
-			},
-			{
-				Role:  "user",
-				Parts: []*genai.Part{genai.NewPartFromText("Follow up")},
-			},
-		}
+func TestBuildRequest(t *testing.T) {
+	echo := &fakeTool{name: "echo", run: func(tool.Context, any) (map[string]any, error) {
+		t.Error("tool must not run while building a request")
+		return nil, nil
+	}}
+	llm, err := New(Config{Model: "gpt-4o", Tools: []tool.Tool{echo}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 
-		result := formatPrompt(contents)
-		expected := "User: Hello\n\nUser: Follow up"
-		if result != expected {
-			t.Errorf("expected %q, got %q", expected, result)
+	preview, err := llm.BuildRequest(&model.LLMRequest{
+		Model: "claude-sonnet-4",
+		Contents: []*genai.Content{
+			{Role: "user", Parts: []*genai.Part{genai.NewPartFromText("Hello")}},
+		},
+	}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if preview.Session.Model != "claude-sonnet-4" || !preview.Session.Streaming {
+		t.Errorf("unexpected session config %+v", preview.Session)
+	}
+	if len(preview.Session.Tools) != 1 || preview.Session.Tools[0].Name != "echo" {
+		t.Fatalf("expected echo tool, got %+v", preview.Session.Tools)
+	}
+	if preview.Session.Tools[0].Handler != nil {
+		t.Error("expected tool handler to be omitted")
+	}
+	if preview.Message.Prompt != "Hello" {
+		t.Errorf("unexpected prompt %q", preview.Message.Prompt)
+	}
+
+	t.Run("redacts provider credentials", func(t *testing.T) {
+		provider := &copilot.ProviderConfig{BaseURL: "https://api.example.com", APIKey: "sk-secret", BearerToken: "token-secret"}
+		llm, err := New(Config{Provider: provider})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
-	})
 
-	t.Run("case insensitive roles", func(t *testing.T) {
-		contents := []*genai.Content{
-			{
-				Role:  "USER",
-				Parts: []*genai.Part{genai.NewPartFromText("Hello")},
-			},
-			{
-				Role:  "MODEL",
-				Parts: []*genai.Part{genai.NewPartFromText("Hi")},
-			},
+		preview, err := llm.BuildRequest(&model.LLMRequest{}, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
 
-		result := formatPrompt(contents)
-		expected := "User: Hello\n\nAssistant: Hi"
-		if result != expected {
-			t.Errorf("expected %q, got %q", expected, result)
+		got := preview.Session.Provider
+		if got == provider {
+			t.Fatal("expected a copy of the provider config")
+		}
+		if got.BaseURL != provider.BaseURL || got.APIKey != "REDACTED" || got.BearerToken != "REDACTED" {
+			t.Errorf("expected redacted credentials, got %+v", got)
+		}
+		if provider.APIKey != "sk-secret" || provider.BearerToken != "token-secret" {
+			t.Errorf("expected the configured provider to be unchanged, got %+v", provider)
 		}
 	})
 }
 
-func TestExtractText(t *testing.T) {
-	t.Run("nil content", func(t *testing.T) {
-		result := extractText(nil)
-		if result != "" {
-			t.Errorf("expected empty string for nil content, got %q", result)
+func TestSessionConfig(t *testing.T) {
+	t.Run("defaults to copilot backend", func(t *testing.T) {
+		llm, err := New(Config{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
-	})
 
-	t.Run("empty parts", func(t *testing.T) {
-		content := &genai.Content{
-			Role:  "user",
-			Parts: []*genai.Part{},
+		cfg := llm.sessionConfig(&model.LLMRequest{}, "gpt-4", true, nil)
+		if cfg.Model != "gpt-4" {
+			t.Errorf("expected model 'gpt-4', got %q", cfg.Model)
 		}
-
-		result := extractText(content)
-		if result != "" {
-			t.Errorf("expected empty string for empty parts, got %q", result)
+		if !cfg.Streaming {
+			t.Error("expected streaming to be true")
+		}
+		if cfg.Provider != nil {
+			t.Errorf("expected nil provider, got %+v", cfg.Provider)
+		}
+		if cfg.SystemMessage != nil {
+			t.Errorf("expected no system message, got %+v", cfg.SystemMessage)
 		}
 	})
 
-	t.Run("nil parts", func(t *testing.T) {
-		content := &genai.Content{
-			Role:  "user",
-			Parts: nil,
+	t.Run("system instruction appended to system message", func(t *testing.T) {
+		llm, err := New(Config{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
 
-		result := extractText(content)
-		if result != "" {
-			t.Errorf("expected empty string for nil parts, got %q", result)
+		req := &model.LLMRequest{Config: &genai.GenerateContentConfig{
+			SystemInstruction: genai.NewContentFromText("You are terse.", "system"),
+		}}
+		cfg := llm.sessionConfig(req, "o3-mini", false, nil)
+		want := &copilot.SystemMessageConfig{Mode: "append", Content: "You are terse."}
+		if !reflect.DeepEqual(cfg.SystemMessage, want) {
+			t.Errorf("expected system message %+v, got %+v", want, cfg.SystemMessage)
 		}
 	})
 
-	t.Run("single text part", func(t *testing.T) {
-		content := &genai.Content{
-			Role:  "user",
-			Parts: []*genai.Part{genai.NewPartFromText("Hello, world!")},
+	t.Run("custom provider base URL", func(t *testing.T) {
+		provider := &copilot.ProviderConfig{
+			Type:    "openai",
+			BaseURL: "http://localhost:11434/v1",
+		}
+		llm, err := New(Config{Provider: provider})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
 
-		result := extractText(content)
-		if result != "Hello, world!" {
-			t.Errorf("expected 'Hello, world!', got %q", result)
+		cfg := llm.sessionConfig(&model.LLMRequest{}, "llama3", false, nil)
+		if cfg.Provider != provider {
+			t.Fatalf("expected configured provider, got %+v", cfg.Provider)
+		}
+		if cfg.Provider.BaseURL != "http://localhost:11434/v1" {
+			t.Errorf("expected base URL 'http://localhost:11434/v1', got %q", cfg.Provider.BaseURL)
 		}
 	})
+}
 
-	t.Run("multiple text parts", func(t *testing.T) {
-		content := &genai.Content{
-			Role: "user",
-			Parts: []*genai.Part{
-				genai.NewPartFromText("First part"),
-				genai.NewPartFromText("Second part"),
-			},
-		}
+func TestRequestContext(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeout      time.Duration
+		streaming    bool
+		wantDeadline bool
+	}{
+		{
+			name:         "no timeout configured",
+			timeout:      0,
+			streaming:    false,
+			wantDeadline: false,
+		},
+		{
+			name:         "negative timeout disables it",
+			timeout:      -1,
+			streaming:    false,
+			wantDeadline: false,
+		},
+		{
+			name:         "non-streaming with timeout",
+			timeout:      30 * time.Second,
+			streaming:    false,
+			wantDeadline: true,
+		},
+		{
+			name:         "streaming ignores timeout",
+			timeout:      30 * time.Second,
+			streaming:    true,
+			wantDeadline: false,
+		},
+	}
 
-		result := extractText(content)
-		expected := "First part\nSecond part"
-		if result != expected {
-			t.Errorf("expected %q, got %q", expected, result)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm, err := New(Config{RequestTimeout: tt.timeout})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			ctx, cancel := llm.requestContext(context.Background(), tt.streaming)
+			defer cancel()
+
+			deadline, ok := ctx.Deadline()
+			if ok != tt.wantDeadline {
+				t.Fatalf("expected deadline %v, got %v", tt.wantDeadline, ok)
+			}
+			if ok && time.Until(deadline) > tt.timeout {
+				t.Errorf("deadline %v is further away than timeout %v", time.Until(deadline), tt.timeout)
+			}
+		})
+	}
+}
+
+func TestCheckContextWindow(t *testing.T) {
+	llm, err := New(Config{GuardContextWindow: true, MaxInputTokens: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := llm.checkContextWindow(10); err != nil {
+		t.Errorf("expected prompt at the limit to pass, got %v", err)
+	}
+
+	err = llm.checkContextWindow(11)
+	if !errors.Is(err, ErrContextWindowExceeded) {
+		t.Fatalf("expected ErrContextWindowExceeded, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "estimated 11 prompt tokens, limit is 10") {
+		t.Errorf("expected counts in error, got %q", err)
+	}
+
+	t.Run("GenerateContent fails before starting the client", func(t *testing.T) {
+		req := &model.LLMRequest{Contents: []*genai.Content{genai.NewContentFromText(strings.Repeat("a", 100), "user")}}
+		_, err := CollectStream(llm.GenerateContent(context.Background(), req, false))
+		if !errors.Is(err, ErrContextWindowExceeded) {
+			t.Fatalf("expected ErrContextWindowExceeded, got %v", err)
+		}
+		if llm.state.started {
+			t.Error("expected client not to be started")
 		}
 	})
 
-	t.Run("parts with empty text skipped", func(t *testing.T) {
-		content := &genai.Content{
-			Role: "user",
-			Parts: []*genai.Part{
-				genai.NewPartFromText("First"),
-				genai.NewPartFromText(""),
-				genai.NewPartFromText("Third"),
-			},
+	t.Run("default limit", func(t *testing.T) {
+		llm, err := New(Config{GuardContextWindow: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
-
-		result := extractText(content)
-		expected := "First\nThird"
-		if result != expected {
-			t.Errorf("expected %q, got %q", expected, result)
+		if llm.config.MaxInputTokens != 128000 {
+			t.Errorf("expected default limit 128000, got %d", llm.config.MaxInputTokens)
 		}
 	})
 }
 
-func TestClose(t *testing.T) {
-	t.Run("close unstarted client", func(t *testing.T) {
-		llm, err := New(Config{})
-		if err != nil {
-			t.Fatalf("unexpected error creating LLM: %v", err)
-		}
+func TestTrimHistory(t *testing.T) {
+	long := strings.Repeat("x", 400)
+	call := &genai.Content{Role: "model", Parts: []*genai.Part{{FunctionCall: &genai.FunctionCall{ID: "call-1", Name: "lookup", Args: map[string]any{"q": long}}}}}
+	result := &genai.Content{Role: "user", Parts: []*genai.Part{{FunctionResponse: &genai.FunctionResponse{ID: "call-1", Name: "lookup", Response: map[string]any{"r": long}}}}}
+	system := genai.NewContentFromText("Be brief.", "system")
+	latest := genai.NewContentFromText("And now?", "user")
 
-		// Ensure client is not started
-		if llm.started {
-			t.Fatal("expected client to not be started")
+	t.Run("fits without trimming", func(t *testing.T) {
+		contents := []*genai.Content{system, latest}
+		kept, trimmed := trimHistory(contents, 1000)
+		if trimmed != 0 || len(kept) != 2 {
+			t.Errorf("expected nothing trimmed, got %d trimmed and %d kept", trimmed, len(kept))
 		}
+	})
 
-		// Close should not error on unstarted client
-		err = llm.Close()
-		if err != nil {
-			t.Errorf("unexpected error closing unstarted client: %v", err)
+	t.Run("drops oldest turns and keeps system", func(t *testing.T) {
+		contents := []*genai.Content{
+			system,
+			genai.NewContentFromText(long, "user"),
+			genai.NewContentFromText(long, "model"),
+			latest,
 		}
-
-		// Verify started is still false
-		if llm.started {
-			t.Error("expected started to remain false after closing unstarted client")
+		kept, trimmed := trimHistory(contents, 50)
+		if trimmed != 2 {
+			t.Fatalf("expected 2 trimmed, got %d", trimmed)
+		}
+		if !reflect.DeepEqual(kept, []*genai.Content{system, latest}) {
+			t.Errorf("unexpected kept contents %v", kept)
 		}
 	})
 
-	t.Run("close is idempotent", func(t *testing.T) {
-		llm, err := New(Config{})
-		if err != nil {
-			t.Fatalf("unexpected error creating LLM: %v", err)
+	t.Run("never splits a call from its result", func(t *testing.T) {
+		contents := []*genai.Content{
+			genai.NewContentFromText("Look it up", "user"),
+			call,
+			result,
+			genai.NewContentFromText("Thanks", "model"),
+			latest,
 		}
+		full := int(estimateTokens(formatPrompt(contents)))
+		// Just enough to require dropping the first turn and into the call
+		kept, trimmed := trimHistory(contents, full-10)
+		if trimmed != 3 {
+			t.Fatalf("expected the call and its result to be dropped together, got %d trimmed", trimmed)
+		}
+		if !reflect.DeepEqual(kept, contents[3:]) {
+			t.Errorf("unexpected kept contents %v", kept)
+		}
+	})
 
-		// Close multiple times should not error
-		for i := 0; i < 3; i++ {
-			err = llm.Close()
-			if err != nil {
-				t.Errorf("unexpected error on close attempt %d: %v", i+1, err)
-			}
+	t.Run("keeps latest content even when too large", func(t *testing.T) {
+		contents := []*genai.Content{genai.NewContentFromText(long, "user")}
+		kept, trimmed := trimHistory(contents, 10)
+		if trimmed != 0 || len(kept) != 1 {
+			t.Errorf("expected latest content kept, got %d trimmed and %d kept", trimmed, len(kept))
 		}
 	})
 }
 
-func TestToolConfiguration(t *testing.T) {
+func TestTrimContents(t *testing.T) {
+	llm, err := New(Config{AutoTrimHistory: true, MaxInputTokens: 20})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req := &model.LLMRequest{Contents: []*genai.Content{
+		genai.NewContentFromText(strings.Repeat("x", 40), "user"),
+		genai.NewContentFromText("And now?", "user"),
+	}}
+
+	if _, trimmed := llm.trimContents(req); trimmed != 0 {
+		t.Fatalf("expected the prompt alone to fit, got %d trimmed", trimmed)
+	}
+
+	// The instruction is sent with the prompt and uses 10 of the 20 tokens
+	req.Config = &genai.GenerateContentConfig{
+		SystemInstruction: &genai.Content{Parts: []*genai.Part{genai.NewPartFromText(strings.Repeat("y", 40))}},
+	}
+	if _, trimmed := llm.trimContents(req); trimmed != 1 {
+		t.Errorf("expected the system instruction to count against the limit, got %d trimmed", trimmed)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	ctx := context.Background()
+	if id := RequestIDFromContext(ctx); id != "" {
+		t.Errorf("expected no request ID, got %q", id)
+	}
+	if id := RequestIDFromContext(WithRequestID(ctx, "req-1")); id != "req-1" {
+		t.Errorf("expected 'req-1', got %q", id)
+	}
+}
+
+func TestCountTokens(t *testing.T) {
+	llm, err := New(Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
 	tests := []struct {
-		name    string
-		tools   []tool.Tool
-		wantErr bool
+		name     string
+		contents []*genai.Content
+		want     int32
 	}{
 		{
-			name:    "nil tools",
-			tools:   nil,
-			wantErr: false,
+			name:     "empty request",
+			contents: nil,
+			want:     0,
 		},
 		{
-			name:    "empty tools",
-			tools:   []tool.Tool{},
-			wantErr: false,
+			name: "single message",
+			contents: []*genai.Content{
+				{Role: "user", Parts: []*genai.Part{genai.NewPartFromText("Hello, world")}},
+			},
+			want: 3,
+		},
+		{
+			name: "multi-turn conversation",
+			contents: []*genai.Content{
+				{Role: "user", Parts: []*genai.Part{genai.NewPartFromText("Hi")}},
+				{Role: "model", Parts: []*genai.Part{genai.NewPartFromText("Hello")}},
+			},
+			// "User: Hi\n\nAssistant: Hello" is 25 characters
+			want: 7,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			llm, err := New(Config{
-				Model: "gpt-4",
-				Tools: tt.tools,
-			})
-			if (err != nil) != tt.wantErr {
-				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			got, err := llm.CountTokens(context.Background(), &model.LLMRequest{Contents: tt.contents})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
 			}
-			if llm != nil {
-				defer llm.Close()
+			if got != tt.want {
+				t.Errorf("CountTokens() = %d, want %d", got, tt.want)
 			}
 		})
 	}
-}
 
-func TestToolContextImplementation(t *testing.T) {
-	ctx := context.Background()
-	tc := &toolContext{
-		ctx:    ctx,
-		callID: "test-call-123",
-	}
+	t.Run("includes the system instruction", func(t *testing.T) {
+		got, err := llm.CountTokens(context.Background(), &model.LLMRequest{
+			Contents: []*genai.Content{
+				{Role: "user", Parts: []*genai.Part{genai.NewPartFromText("Hello, world")}},
+			},
+			Config: &genai.GenerateContentConfig{
+				SystemInstruction: &genai.Content{Parts: []*genai.Part{genai.NewPartFromText("Be brief.")}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// 3 tokens of prompt and 3 of instruction
+		if got != 6 {
+			t.Errorf("CountTokens() = %d, want 6", got)
+		}
+	})
 
-	// Test Context()
-	if tc.Context() != ctx {
-		t.Errorf("Context() returned wrong context")
-	}
+	t.Run("cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
 
-	// Test FunctionCallID()
-	if got := tc.FunctionCallID(); got != "test-call-123" {
-		t.Errorf("FunctionCallID() = %q, want %q", got, "test-call-123")
-	}
+		if _, err := llm.CountTokens(ctx, &model.LLMRequest{}); err == nil {
+			t.Error("expected error for cancelled context")
+		}
+	})
+}
 
-	// Test nil returns for agent-runtime features
-	if tc.Agent() != nil {
-		t.Errorf("Agent() should return nil in standalone mode")
-	}
-	if tc.Session() != nil {
-		t.Errorf("Session() should return nil in standalone mode")
-	}
-	if tc.Actions() != nil {
-		t.Errorf("Actions() should return nil in standalone mode")
+func TestName(t *testing.T) {
+	llm, err := New(Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	// Test SearchMemory returns error
-	_, err := tc.SearchMemory(ctx, "test query")
-	if err == nil {
-		t.Errorf("SearchMemory() should return error in standalone mode")
+	if llm.Name() != "github-copilot" {
+		t.Errorf("expected name 'github-copilot', got %q", llm.Name())
 	}
 }
 
-func TestDeclarationToParams(t *testing.T) {
+func TestValidateContents(t *testing.T) {
 	tests := []struct {
-		name string
-		decl *genai.FunctionDeclaration
-		want map[string]interface{}
+		name    string
+		part    *genai.Part
+		wantErr string
 	}{
-		{
-			name: "nil declaration",
-			decl: &genai.FunctionDeclaration{},
-			want: nil,
-		},
-		{
-			name: "with ParametersJsonSchema",
-			decl: &genai.FunctionDeclaration{
-				ParametersJsonSchema: map[string]interface{}{
-					"type": "object",
-					"properties": map[string]interface{}{
-						"name": map[string]interface{}{"type": "string"},
-					},
-				},
-			},
-			want: map[string]interface{}{
-				"type": "object",
-				"properties": map[string]interface{}{
-					"name": map[string]interface{}{"type": "string"},
-				},
-			},
-		},
+		{name: "text", part: genai.NewPartFromText("hi")},
+		{name: "function call", part: genai.NewPartFromFunctionCall("lookup", nil)},
+		{name: "inline data", part: genai.NewPartFromBytes([]byte{0x89}, "image/png"), wantErr: "unsupported inline data part (image/png) in content 1"},
+		{name: "file data", part: genai.NewPartFromURI("gs://bucket/a.pdf", "application/pdf"), wantErr: "unsupported file data part (gs://bucket/a.pdf) in content 1"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := declarationToParams(tt.decl)
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("declarationToParams() = %v, want %v", got, tt.want)
+			contents := []*genai.Content{
+				genai.NewContentFromText("Look at this", "user"),
+				{Role: "user", Parts: []*genai.Part{tt.part}},
+			}
+			err := validateContents(contents)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
 			}
 		})
 	}
-}
 
-func TestSchemaToMap(t *testing.T) {
-	t.Run("nil schema", func(t *testing.T) {
-		result := schemaToMap(nil)
-		if result != nil {
-			t.Errorf("expected nil result, got %v", result)
+	t.Run("GenerateContent fails before starting the client", func(t *testing.T) {
+		llm, err := New(Config{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		req := &model.LLMRequest{Contents: []*genai.Content{{Role: "user", Parts: []*genai.Part{genai.NewPartFromBytes([]byte{0x89}, "image/png")}}}}
+		if _, err := CollectStream(llm.GenerateContent(context.Background(), req, false)); err == nil {
+			t.Fatal("expected error for inline data")
+		}
+		if llm.state.started {
+			t.Error("expected client not to be started")
 		}
 	})
+}
 
-	t.Run("empty schema", func(t *testing.T) {
-		result := schemaToMap(&genai.Schema{})
-		if len(result) != 0 {
-			t.Errorf("expected empty map, got %v", result)
+func TestFormatPrompt(t *testing.T) {
+	t.Run("empty contents", func(t *testing.T) {
+		result := formatPrompt(nil)
+		if result != "" {
+			t.Errorf("expected empty string for nil contents, got %q", result)
 		}
-	})
 
-	t.Run("simple string schema", func(t *testing.T) {
-		schema := &genai.Schema{
-			Type:        genai.TypeString,
-			Description: "A string field",
+		result = formatPrompt([]*genai.Content{})
+		if result != "" {
+			t.Errorf("expected empty string for empty contents, got %q", result)
 		}
+	})
 
-		result := schemaToMap(schema)
-		if result["type"] != "string" {
-			t.Errorf("expected type 'string', got %v", result["type"])
+	t.Run("single content", func(t *testing.T) {
+		contents := []*genai.Content{
+			{
+				Role:  "user",
+				Parts: []*genai.Part{genai.NewPartFromText("Hello, world!")},
+			},
 		}
-		if result["description"] != "A string field" {
-			t.Errorf("expected description 'A string field', got %v", result["description"])
+
+		result := formatPrompt(contents)
+		if result != "Hello, world!" {
+			t.Errorf("expected 'Hello, world!', got %q", result)
 		}
 	})
 
-	t.Run("object schema with properties", func(t *testing.T) {
-		schema := &genai.Schema{
-			Type: genai.TypeObject,
-			Properties: map[string]*genai.Schema{
-				"name": {
-					Type:        genai.TypeString,
-					Description: "Name field",
+	t.Run("thought parts skipped and code parts rendered", func(t *testing.T) {
+		contents := []*genai.Content{
+			genai.NewContentFromText("Compute 2+2", "user"),
+			{
+				Role: "model",
+				Parts: []*genai.Part{
+					{Text: "I should run code", Thought: true},
+					{ThoughtSignature: []byte("sig")},
+					{ExecutableCode: &genai.ExecutableCode{Code: "print(2+2)", Language: genai.LanguagePython}},
+					{CodeExecutionResult: &genai.CodeExecutionResult{Outcome: genai.OutcomeOK, Output: "4"}},
+					genai.NewPartFromText("It is 4."),
 				},
-				"age": {
-					Type:        genai.TypeInteger,
-					Description: "Age field",
+			},
+		}
+
+		result := formatPrompt(contents)
+		expected := "User: Compute 2+2\n\nAssistant: ```python\nprint(2+2)\n```\nCode execution result (OUTCOME_OK): 4\nIt is 4."
+		if result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
+		}
+	})
+
+	t.Run("multiple text parts joined into one turn", func(t *testing.T) {
+		contents := []*genai.Content{
+			{
+				Role: "user",
+				Parts: []*genai.Part{
+					genai.NewPartFromText("Summarize this:"),
+					genai.NewPartFromText("first fragment"),
+					genai.NewPartFromText("second fragment"),
 				},
 			},
-			Required: []string{"name"},
+			{
+				Role:  "model",
+				Parts: []*genai.Part{genai.NewPartFromText("Done.")},
+			},
 		}
 
-		result := schemaToMap(schema)
-		if result["type"] != "object" {
-			t.Errorf("expected type 'object', got %v", result["type"])
+		result := formatPrompt(contents)
+		expected := "User: Summarize this:\nfirst fragment\nsecond fragment\n\nAssistant: Done."
+		if result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
 		}
+	})
 
-		props, ok := result["properties"].(map[string]interface{})
-		if !ok {
-			t.Fatal("expected properties to be map[string]interface{}")
+	t.Run("multi-turn conversation with user", func(t *testing.T) {
+		contents := []*genai.Content{
+			{
+				Role:  "user",
+				Parts: []*genai.Part{genai.NewPartFromText("Hello")},
+			},
+			{
+				Role:  "model",
+				Parts: []*genai.Part{genai.NewPartFromText("Hi there!")},
+			},
 		}
-		if len(props) != 2 {
-			t.Errorf("expected 2 properties, got %d", len(props))
+
+		result := formatPrompt(contents)
+		expected := "User: Hello\n\nAssistant: Hi there!"
+		if result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
 		}
+	})
 
-		required, ok := result["required"].([]string)
-		if !ok {
-			t.Fatal("expected required to be []string")
+	t.Run("model role mapped to Assistant", func(t *testing.T) {
+		contents := []*genai.Content{
+			{
+				Role:  "user",
+				Parts: []*genai.Part{genai.NewPartFromText("Question")},
+			},
+			{
+				Role:  "model",
+				Parts: []*genai.Part{genai.NewPartFromText("Answer")},
+			},
 		}
-		if len(required) != 1 || required[0] != "name" {
-			t.Errorf("expected required=['name'], got %v", required)
+
+		result := formatPrompt(contents)
+		expected := "User: Question\n\nAssistant: Answer"
+		if result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
 		}
 	})
 
-	t.Run("array schema", func(t *testing.T) {
-		schema := &genai.Schema{
-			Type: genai.TypeArray,
-			Items: &genai.Schema{
-				Type: genai.TypeString,
+	t.Run("assistant role", func(t *testing.T) {
+		contents := []*genai.Content{
+			{
+				Role:  "user",
+				Parts: []*genai.Part{genai.NewPartFromText("Question")},
+			},
+			{
+				Role:  "assistant",
+				Parts: []*genai.Part{genai.NewPartFromText("Answer")},
 			},
 		}
 
-		result := schemaToMap(schema)
-		if result["type"] != "array" {
-			t.Errorf("expected type 'array', got %v", result["type"])
+		result := formatPrompt(contents)
+		expected := "User: Question\n\nAssistant: Answer"
+		if result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
 		}
+	})
 
-		items, ok := result["items"].(map[string]interface{})
-		if !ok {
-			t.Fatal("expected items to be map[string]interface{}")
+	t.Run("system role", func(t *testing.T) {
+		contents := []*genai.Content{
+			{
+				Role:  "system",
+				Parts: []*genai.Part{genai.NewPartFromText("You are helpful")},
+			},
+			{
+				Role:  "user",
+				Parts: []*genai.Part{genai.NewPartFromText("Hello")},
+			},
 		}
-		if items["type"] != "string" {
-			t.Errorf("expected items type 'string', got %v", items["type"])
+
+		result := formatPrompt(contents)
+		expected := "System: You are helpful\n\nUser: Hello"
+		if result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
 		}
 	})
 
-	t.Run("enum schema", func(t *testing.T) {
-		schema := &genai.Schema{
-			Type: genai.TypeString,
-			Enum: []string{"option1", "option2", "option3"},
+	t.Run("unknown role uses role name", func(t *testing.T) {
+		contents := []*genai.Content{
+			{
+				Role:  "custom",
+				Parts: []*genai.Part{genai.NewPartFromText("Custom message")},
+			},
+			{
+				Role:  "user",
+				Parts: []*genai.Part{genai.NewPartFromText("Hello")},
+			},
 		}
 
-		result := schemaToMap(schema)
-		enum, ok := result["enum"].([]string)
-		if !ok {
-			t.Fatal("expected enum to be []string")
+		result := formatPrompt(contents)
+		expected := "custom: Custom message\n\nUser: Hello"
+		if result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
 		}
-		if len(enum) != 3 {
-			t.Errorf("expected 3 enum values, got %d", len(enum))
+	})
+
+	t.Run("skips empty content", func(t *testing.T) {
+		contents := []*genai.Content{
+			{
+				Role:  "user",
+				Parts: []*genai.Part{genai.NewPartFromText("Hello")},
+			},
+			{
+				Role:  "model",
+				Parts: []*genai.Part{}, // Empty parts
+			},
+			{
+				Role:  "user",
+				Parts: []*genai.Part{genai.NewPartFromText("Follow up")},
+			},
+		}
+
+		result := formatPrompt(contents)
+		expected := "User: Hello\n\nUser: Follow up"
+		if result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
 		}
 	})
 
-	t.Run("numeric constraints", func(t *testing.T) {
-		min := 0.0
-		max := 100.0
-		schema := &genai.Schema{
-			Type:    genai.TypeNumber,
-			Minimum: &min,
-			Maximum: &max,
+	t.Run("case insensitive roles", func(t *testing.T) {
+		contents := []*genai.Content{
+			{
+				Role:  "USER",
+				Parts: []*genai.Part{genai.NewPartFromText("Hello")},
+			},
+			{
+				Role:  "MODEL",
+				Parts: []*genai.Part{genai.NewPartFromText("Hi")},
+			},
 		}
 
-		result := schemaToMap(schema)
-		if result["minimum"] != 0.0 {
-			t.Errorf("expected minimum 0.0, got %v", result["minimum"])
+		result := formatPrompt(contents)
+		expected := "User: Hello\n\nAssistant: Hi"
+		if result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
 		}
-		if result["maximum"] != 100.0 {
-			t.Errorf("expected maximum 100.0, got %v", result["maximum"])
+	})
+
+	t.Run("function response rendered as tool turn", func(t *testing.T) {
+		contents := []*genai.Content{
+			{
+				Role:  "user",
+				Parts: []*genai.Part{genai.NewPartFromText("What is 2+3?")},
+			},
+			{
+				Role: "user",
+				Parts: []*genai.Part{{
+					FunctionResponse: &genai.FunctionResponse{
+						ID:       "call-1",
+						Name:     "calculator",
+						Response: map[string]any{"result": 5},
+					},
+				}},
+			},
+		}
+
+		result := formatPrompt(contents)
+		expected := "User: What is 2+3?\n\nTool: Result of calculator (call call-1): {\"result\":5}"
+		if result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
 		}
 	})
 
-	t.Run("string constraints", func(t *testing.T) {
-		minLen := int64(1)
-		maxLen := int64(50)
-		schema := &genai.Schema{
-			Type:      genai.TypeString,
-			MinLength: &minLen,
-			MaxLength: &maxLen,
-			Pattern:   "^[a-z]+$",
-			Format:    "email",
+	t.Run("assistant turn mixing text and function calls", func(t *testing.T) {
+		contents := []*genai.Content{
+			{
+				Role:  "user",
+				Parts: []*genai.Part{genai.NewPartFromText("Add 2 and 3, then double it")},
+			},
+			{
+				Role: "model",
+				Parts: []*genai.Part{
+					genai.NewPartFromText("Let me calculate."),
+					{FunctionCall: &genai.FunctionCall{ID: "call-1", Name: "add", Args: map[string]any{"a": 2, "b": 3}}},
+					{FunctionCall: &genai.FunctionCall{ID: "call-2", Name: "double", Args: map[string]any{"x": 5}}},
+				},
+			},
+			{
+				Role: "user",
+				Parts: []*genai.Part{
+					{FunctionResponse: &genai.FunctionResponse{ID: "call-1", Name: "add", Response: map[string]any{"result": 5}}},
+					{FunctionResponse: &genai.FunctionResponse{ID: "call-2", Name: "double", Response: map[string]any{"result": 10}}},
+				},
+			},
 		}
 
-		result := schemaToMap(schema)
-		if result["minLength"] != int64(1) {
-			t.Errorf("expected minLength 1, got %v", result["minLength"])
+		result := formatPrompt(contents)
+		expected := "User: Add 2 and 3, then double it\n\n" +
+			"Assistant: Let me calculate.\n" +
+			"Called add (call call-1) with {\"a\":2,\"b\":3}\n" +
+			"Called double (call call-2) with {\"x\":5}\n\n" +
+			"Tool: Result of add (call call-1): {\"result\":5}\n" +
+			"Result of double (call call-2): {\"result\":10}"
+		if result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
 		}
-		if result["maxLength"] != int64(50) {
-			t.Errorf("expected maxLength 50, got %v", result["maxLength"])
+	})
+
+	t.Run("tool role", func(t *testing.T) {
+		contents := []*genai.Content{
+			{
+				Role:  "user",
+				Parts: []*genai.Part{genai.NewPartFromText("Weather?")},
+			},
+			{
+				Role:  "tool",
+				Parts: []*genai.Part{genai.NewPartFromText("Sunny")},
+			},
 		}
-		if result["pattern"] != "^[a-z]+$" {
-			t.Errorf("expected pattern '^[a-z]+$', got %v", result["pattern"])
+
+		result := formatPrompt(contents)
+		expected := "User: Weather?\n\nTool: Sunny"
+		if result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
 		}
-		if result["format"] != "email" {
-			t.Errorf("expected format 'email', got %v", result["format"])
+	})
+}
+
+func TestFormatFunctionCall(t *testing.T) {
+	tests := []struct {
+		name string
+		fc   *genai.FunctionCall
+		want string
+	}{
+		{
+			name: "with call ID",
+			fc:   &genai.FunctionCall{ID: "abc", Name: "lookup", Args: map[string]any{"q": "go"}},
+			want: `Called lookup (call abc) with {"q":"go"}`,
+		},
+		{
+			name: "without call ID",
+			fc:   &genai.FunctionCall{Name: "lookup", Args: map[string]any{"q": "go"}},
+			want: `Called lookup with {"q":"go"}`,
+		},
+		{
+			name: "no arguments",
+			fc:   &genai.FunctionCall{Name: "now"},
+			want: "Called now with null",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatFunctionCall(tt.fc); got != tt.want {
+				t.Errorf("formatFunctionCall() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatFunctionResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		fr   *genai.FunctionResponse
+		want string
+	}{
+		{
+			name: "with call ID",
+			fr:   &genai.FunctionResponse{ID: "abc", Name: "lookup", Response: map[string]any{"ok": true}},
+			want: `Result of lookup (call abc): {"ok":true}`,
+		},
+		{
+			name: "without call ID",
+			fr:   &genai.FunctionResponse{Name: "lookup", Response: map[string]any{"ok": true}},
+			want: `Result of lookup: {"ok":true}`,
+		},
+		{
+			name: "nil response",
+			fr:   &genai.FunctionResponse{Name: "noop"},
+			want: "Result of noop: null",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatFunctionResponse(tt.fr); got != tt.want {
+				t.Errorf("formatFunctionResponse() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractText(t *testing.T) {
+	t.Run("nil content", func(t *testing.T) {
+		result := extractText(nil)
+		if result != "" {
+			t.Errorf("expected empty string for nil content, got %q", result)
+		}
+	})
+
+	t.Run("empty parts", func(t *testing.T) {
+		content := &genai.Content{
+			Role:  "user",
+			Parts: []*genai.Part{},
+		}
+
+		result := extractText(content)
+		if result != "" {
+			t.Errorf("expected empty string for empty parts, got %q", result)
+		}
+	})
+
+	t.Run("nil parts", func(t *testing.T) {
+		content := &genai.Content{
+			Role:  "user",
+			Parts: nil,
+		}
+
+		result := extractText(content)
+		if result != "" {
+			t.Errorf("expected empty string for nil parts, got %q", result)
+		}
+	})
+
+	t.Run("single text part", func(t *testing.T) {
+		content := &genai.Content{
+			Role:  "user",
+			Parts: []*genai.Part{genai.NewPartFromText("Hello, world!")},
+		}
+
+		result := extractText(content)
+		if result != "Hello, world!" {
+			t.Errorf("expected 'Hello, world!', got %q", result)
+		}
+	})
+
+	t.Run("multiple text parts", func(t *testing.T) {
+		content := &genai.Content{
+			Role: "user",
+			Parts: []*genai.Part{
+				genai.NewPartFromText("First part"),
+				genai.NewPartFromText("Second part"),
+			},
+		}
+
+		result := extractText(content)
+		expected := "First part\nSecond part"
+		if result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
+		}
+	})
+
+	t.Run("parts with empty text skipped", func(t *testing.T) {
+		content := &genai.Content{
+			Role: "user",
+			Parts: []*genai.Part{
+				genai.NewPartFromText("First"),
+				genai.NewPartFromText(""),
+				genai.NewPartFromText("Third"),
+			},
+		}
+
+		result := extractText(content)
+		expected := "First\nThird"
+		if result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
+		}
+	})
+}
+
+func TestClose(t *testing.T) {
+	t.Run("close unstarted client", func(t *testing.T) {
+		llm, err := New(Config{})
+		if err != nil {
+			t.Fatalf("unexpected error creating LLM: %v", err)
+		}
+
+		// Ensure client is not started
+		if llm.state.started {
+			t.Fatal("expected client to not be started")
+		}
+
+		// Close should not error on unstarted client
+		err = llm.Close()
+		if err != nil {
+			t.Errorf("unexpected error closing unstarted client: %v", err)
+		}
+
+		// Verify started is still false
+		if llm.state.started {
+			t.Error("expected started to remain false after closing unstarted client")
+		}
+	})
+
+	t.Run("close is idempotent", func(t *testing.T) {
+		llm, err := New(Config{})
+		if err != nil {
+			t.Fatalf("unexpected error creating LLM: %v", err)
+		}
+
+		// Close multiple times should not error
+		for i := 0; i < 3; i++ {
+			err = llm.Close()
+			if err != nil {
+				t.Errorf("unexpected error on close attempt %d: %v", i+1, err)
+			}
+		}
+	})
+}
+
+// fakeTool is a minimal function tool for exercising tool conversion.
+type fakeTool struct {
+	name string
+	run  func(tool.Context, any) (map[string]any, error)
+}
+
+func (f *fakeTool) Name() string        { return f.name }
+func (f *fakeTool) Description() string { return "fake tool " + f.name }
+func (f *fakeTool) IsLongRunning() bool { return false }
+
+func (f *fakeTool) Declaration() *genai.FunctionDeclaration {
+	return &genai.FunctionDeclaration{
+		Name:        f.name,
+		Description: f.Description(),
+		Parameters:  &genai.Schema{Type: genai.TypeObject},
+	}
+}
+
+func (f *fakeTool) Run(ctx tool.Context, args any) (map[string]any, error) {
+	return f.run(ctx, args)
+}
+
+func TestConvertAdkToolsParallel(t *testing.T) {
+	const limit = 2
+	const calls = 6
+
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	release := make(chan struct{})
+
+	echo := &fakeTool{
+		name: "echo",
+		run: func(ctx tool.Context, args any) (map[string]any, error) {
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+
+			<-release
+
+			mu.Lock()
+			active--
+			mu.Unlock()
+			return map[string]any{"callID": ctx.FunctionCallID()}, nil
+		},
+	}
+
+	llm, err := New(Config{MaxParallelTools: limit})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	copilotTools, err := llm.convertAdkTools(context.Background(), []tool.Tool{echo}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	results := make([]copilot.ToolResult, calls)
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = copilotTools[0].Handler(copilot.ToolInvocation{
+				ToolCallID: fmt.Sprintf("call-%d", i),
+				ToolName:   "echo",
+			})
+		}(i)
+	}
+
+	// Wait until the pool is saturated before letting the calls finish
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		saturated := active == limit
+		mu.Unlock()
+		if saturated {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for concurrent tool calls")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if maxActive != limit {
+		t.Errorf("expected at most %d concurrent calls, got %d", limit, maxActive)
+	}
+	for i, result := range results {
+		want := fmt.Sprintf(`{"callID":"call-%d"}`, i)
+		if result.TextResultForLLM != want {
+			t.Errorf("result %d: expected %s, got %q", i, want, result.TextResultForLLM)
+		}
+	}
+}
+
+func TestConvertAdkToolsErrors(t *testing.T) {
+	failing := &fakeTool{
+		name: "divide",
+		run: func(tool.Context, any) (map[string]any, error) {
+			return nil, errors.New("division by zero")
+		},
+	}
+
+	llm, err := New(Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Run("error reported to model", func(t *testing.T) {
+		copilotTools, err := llm.convertAdkTools(context.Background(), []tool.Tool{failing}, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		result, err := copilotTools[0].Handler(copilot.ToolInvocation{ToolCallID: "call-1", ToolName: "divide"})
+		if err != nil {
+			t.Fatalf("expected handler to recover, got error: %v", err)
+		}
+		if result.Error != "division by zero" {
+			t.Errorf("expected tool error in result, got %q", result.Error)
+		}
+	})
+
+	t.Run("error reported to onError", func(t *testing.T) {
+		var reported error
+		copilotTools, err := llm.convertAdkTools(context.Background(), []tool.Tool{failing}, func(err error) {
+			reported = err
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		result, _ := copilotTools[0].Handler(copilot.ToolInvocation{ToolCallID: "call-1", ToolName: "divide"})
+		if result.Error != "division by zero" {
+			t.Errorf("expected tool error in result, got %q", result.Error)
+		}
+		if reported == nil {
+			t.Fatal("expected onError to be called")
+		}
+		if reported.Error() != `tool "divide" failed: division by zero` {
+			t.Errorf("unexpected reported error: %v", reported)
+		}
+	})
+
+	t.Run("error counted in metrics", func(t *testing.T) {
+		metrics := &recordingMetrics{}
+		llm, err := New(Config{Metrics: metrics})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		copilotTools, err := llm.convertAdkTools(context.Background(), []tool.Tool{failing}, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		copilotTools[0].Handler(copilot.ToolInvocation{ToolCallID: "call-1", ToolName: "divide"})
+		if !reflect.DeepEqual(metrics.errors, []string{"tool"}) {
+			t.Errorf("expected a tool error, got %v", metrics.errors)
+		}
+	})
+
+	t.Run("aborting tool error counted once", func(t *testing.T) {
+		metrics := &recordingMetrics{}
+		llm, err := New(Config{Metrics: metrics})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var reported error
+		copilotTools, err := llm.convertAdkTools(context.Background(), []tool.Tool{failing}, func(err error) {
+			reported = err
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		copilotTools[0].Handler(copilot.ToolInvocation{ToolCallID: "call-1", ToolName: "divide"})
+		// The request then fails with the reported error, as under FailOnToolError
+		metricsYield(metrics, "gpt-4", time.Now, func(*model.LLMResponse, error) bool { return false })(nil, reported)
+
+		if errorKind(reported) != "tool" {
+			t.Errorf("expected the reported error to classify as a tool error, got %q", errorKind(reported))
+		}
+		if !reflect.DeepEqual(metrics.errors, []string{"tool"}) {
+			t.Errorf("expected a single tool error, got %v", metrics.errors)
+		}
+	})
+}
+
+func TestRegisterTool(t *testing.T) {
+	noop := func(tool.Context, any) (map[string]any, error) { return nil, nil }
+	toolNames := func(tools []tool.Tool) []string {
+		names := make([]string, 0, len(tools))
+		for _, t := range tools {
+			names = append(names, t.Name())
+		}
+		return names
+	}
+
+	t.Run("register and unregister", func(t *testing.T) {
+		llm, err := New(Config{Tools: []tool.Tool{&fakeTool{name: "a", run: noop}}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		llm.RegisterTool(&fakeTool{name: "b", run: noop})
+		if got := toolNames(llm.currentTools()); !reflect.DeepEqual(got, []string{"a", "b"}) {
+			t.Errorf("expected tools [a b], got %v", got)
+		}
+
+		llm.UnregisterTool("a")
+		if got := toolNames(llm.currentTools()); !reflect.DeepEqual(got, []string{"b"}) {
+			t.Errorf("expected tools [b], got %v", got)
+		}
+
+		llm.UnregisterTool("missing")
+		if got := toolNames(llm.currentTools()); !reflect.DeepEqual(got, []string{"b"}) {
+			t.Errorf("expected tools [b], got %v", got)
+		}
+	})
+
+	t.Run("register replaces same name", func(t *testing.T) {
+		llm, err := New(Config{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		first := &fakeTool{name: "a", run: noop}
+		second := &fakeTool{name: "a", run: noop}
+		llm.RegisterTool(first)
+		llm.RegisterTool(second)
+
+		tools := llm.currentTools()
+		if len(tools) != 1 || tools[0] != second {
+			t.Errorf("expected only the replacement tool, got %v", toolNames(tools))
+		}
+	})
+
+	t.Run("request tools override registered tools", func(t *testing.T) {
+		registered := []tool.Tool{&fakeTool{name: "a", run: noop}, &fakeTool{name: "b", run: noop}}
+		override := &fakeTool{name: "b", run: noop}
+		extra := &fakeTool{name: "c", run: noop}
+
+		merged := mergeTools(registered, []tool.Tool{override, extra})
+		if got := toolNames(merged); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+			t.Fatalf("expected tools [a b c], got %v", got)
+		}
+		if merged[1] != override {
+			t.Error("expected request tool to replace the registered one")
+		}
+		if registered[1] == override {
+			t.Error("expected registered tools to be unchanged")
+		}
+		if got := mergeTools(registered, nil); len(got) != 2 {
+			t.Errorf("expected registered tools without overrides, got %v", toolNames(got))
+		}
+	})
+
+	t.Run("registered tools sorted by name", func(t *testing.T) {
+		llm, err := New(Config{Tools: []tool.Tool{&fakeTool{name: "search", run: noop}}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := llm.RegisteredTools(); !reflect.DeepEqual(got, []string{"search"}) {
+			t.Errorf("expected [search], got %v", got)
+		}
+
+		llm.RegisterTool(&fakeTool{name: "calculator", run: noop})
+		llm.RegisterTool(&fakeTool{name: "weather", run: noop})
+		llm.UnregisterTool("search")
+		if got := llm.RegisteredTools(); !reflect.DeepEqual(got, []string{"calculator", "weather"}) {
+			t.Errorf("expected [calculator weather], got %v", got)
+		}
+	})
+
+	t.Run("snapshot unaffected by later changes", func(t *testing.T) {
+		llm, err := New(Config{Tools: []tool.Tool{&fakeTool{name: "a", run: noop}}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		snapshot := llm.currentTools()
+		llm.RegisterTool(&fakeTool{name: "b", run: noop})
+		llm.UnregisterTool("a")
+
+		if got := toolNames(snapshot); !reflect.DeepEqual(got, []string{"a"}) {
+			t.Errorf("expected snapshot [a], got %v", got)
+		}
+	})
+
+	t.Run("concurrent use", func(t *testing.T) {
+		llm, err := New(Config{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				name := fmt.Sprintf("tool-%d", i%5)
+				llm.RegisterTool(&fakeTool{name: name, run: noop})
+				llm.UnregisterTool(name)
+			}(i)
+			go func() {
+				defer wg.Done()
+				_ = llm.currentTools()
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestToolConfiguration(t *testing.T) {
+	tests := []struct {
+		name    string
+		tools   []tool.Tool
+		wantErr bool
+	}{
+		{
+			name:    "nil tools",
+			tools:   nil,
+			wantErr: false,
+		},
+		{
+			name:    "empty tools",
+			tools:   []tool.Tool{},
+			wantErr: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm, err := New(Config{
+				Model: "gpt-4",
+				Tools: tt.tools,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if llm != nil {
+				defer llm.Close()
+			}
+		})
+	}
+}
+
+func TestToolContextImplementation(t *testing.T) {
+	ctx := context.Background()
+	tc := &toolContext{
+		ctx:    ctx,
+		callID: "test-call-123",
+	}
+
+	// Test Context()
+	if tc.Context() != ctx {
+		t.Errorf("Context() returned wrong context")
+	}
+
+	// Test FunctionCallID()
+	if got := tc.FunctionCallID(); got != "test-call-123" {
+		t.Errorf("FunctionCallID() = %q, want %q", got, "test-call-123")
+	}
+
+	// Test nil returns for agent-runtime features
+	if tc.Agent() != nil {
+		t.Errorf("Agent() should return nil in standalone mode")
+	}
+	if tc.Session() != nil {
+		t.Errorf("Session() should return nil in standalone mode")
+	}
+	if tc.Actions() != nil {
+		t.Errorf("Actions() should return nil in standalone mode")
+	}
+
+	// Test SearchMemory returns error
+	_, err := tc.SearchMemory(ctx, "test query")
+	if err == nil {
+		t.Errorf("SearchMemory() should return error in standalone mode")
+	}
+}
+
+func TestDeclarationToParams(t *testing.T) {
+	tests := []struct {
+		name string
+		decl *genai.FunctionDeclaration
+		want map[string]interface{}
+	}{
+		{
+			name: "nil declaration",
+			decl: &genai.FunctionDeclaration{},
+			want: nil,
+		},
+		{
+			name: "with ParametersJsonSchema",
+			decl: &genai.FunctionDeclaration{
+				ParametersJsonSchema: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"name": map[string]interface{}{"type": "string"},
+					},
+				},
+			},
+			want: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"name": map[string]interface{}{"type": "string"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := declarationToParams(tt.decl)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("declarationToParams() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchemaToMap(t *testing.T) {
+	t.Run("nil schema", func(t *testing.T) {
+		result := schemaToMap(nil)
+		if result != nil {
+			t.Errorf("expected nil result, got %v", result)
+		}
+	})
+
+	t.Run("empty schema", func(t *testing.T) {
+		result := schemaToMap(&genai.Schema{})
+		if len(result) != 0 {
+			t.Errorf("expected empty map, got %v", result)
+		}
+	})
+
+	t.Run("simple string schema", func(t *testing.T) {
+		schema := &genai.Schema{
+			Type:        genai.TypeString,
+			Description: "A string field",
+		}
+
+		result := schemaToMap(schema)
+		if result["type"] != "string" {
+			t.Errorf("expected type 'string', got %v", result["type"])
+		}
+		if result["description"] != "A string field" {
+			t.Errorf("expected description 'A string field', got %v", result["description"])
+		}
+	})
+
+	t.Run("object schema with properties", func(t *testing.T) {
+		schema := &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"name": {
+					Type:        genai.TypeString,
+					Description: "Name field",
+				},
+				"age": {
+					Type:        genai.TypeInteger,
+					Description: "Age field",
+				},
+			},
+			Required: []string{"name"},
+		}
+
+		result := schemaToMap(schema)
+		if result["type"] != "object" {
+			t.Errorf("expected type 'object', got %v", result["type"])
+		}
+
+		props, ok := result["properties"].(map[string]interface{})
+		if !ok {
+			t.Fatal("expected properties to be map[string]interface{}")
+		}
+		if len(props) != 2 {
+			t.Errorf("expected 2 properties, got %d", len(props))
+		}
+
+		required, ok := result["required"].([]string)
+		if !ok {
+			t.Fatal("expected required to be []string")
+		}
+		if len(required) != 1 || required[0] != "name" {
+			t.Errorf("expected required=['name'], got %v", required)
+		}
+	})
+
+	t.Run("array schema", func(t *testing.T) {
+		schema := &genai.Schema{
+			Type: genai.TypeArray,
+			Items: &genai.Schema{
+				Type: genai.TypeString,
+			},
+		}
+
+		result := schemaToMap(schema)
+		if result["type"] != "array" {
+			t.Errorf("expected type 'array', got %v", result["type"])
+		}
+
+		items, ok := result["items"].(map[string]interface{})
+		if !ok {
+			t.Fatal("expected items to be map[string]interface{}")
+		}
+		if items["type"] != "string" {
+			t.Errorf("expected items type 'string', got %v", items["type"])
+		}
+	})
+
+	t.Run("enum schema", func(t *testing.T) {
+		schema := &genai.Schema{
+			Type: genai.TypeString,
+			Enum: []string{"option1", "option2", "option3"},
+		}
+
+		result := schemaToMap(schema)
+		enum, ok := result["enum"].([]string)
+		if !ok {
+			t.Fatal("expected enum to be []string")
+		}
+		if len(enum) != 3 {
+			t.Errorf("expected 3 enum values, got %d", len(enum))
+		}
+	})
+
+	t.Run("numeric constraints", func(t *testing.T) {
+		min := 0.0
+		max := 100.0
+		schema := &genai.Schema{
+			Type:    genai.TypeNumber,
+			Minimum: &min,
+			Maximum: &max,
+		}
+
+		result := schemaToMap(schema)
+		if result["minimum"] != 0.0 {
+			t.Errorf("expected minimum 0.0, got %v", result["minimum"])
+		}
+		if result["maximum"] != 100.0 {
+			t.Errorf("expected maximum 100.0, got %v", result["maximum"])
+		}
+	})
+
+	t.Run("string constraints", func(t *testing.T) {
+		minLen := int64(1)
+		maxLen := int64(50)
+		schema := &genai.Schema{
+			Type:      genai.TypeString,
+			MinLength: &minLen,
+			MaxLength: &maxLen,
+			Pattern:   "^[a-z]+$",
+			Format:    "email",
+		}
+
+		result := schemaToMap(schema)
+		if result["minLength"] != int64(1) {
+			t.Errorf("expected minLength 1, got %v", result["minLength"])
+		}
+		if result["maxLength"] != int64(50) {
+			t.Errorf("expected maxLength 50, got %v", result["maxLength"])
+		}
+		if result["pattern"] != "^[a-z]+$" {
+			t.Errorf("expected pattern '^[a-z]+$', got %v", result["pattern"])
+		}
+		if result["format"] != "email" {
+			t.Errorf("expected format 'email', got %v", result["format"])
+		}
+	})
+}
+
+// newEvent builds a session event of the given type for handler tests.
+func newEvent(t *testing.T, eventType string, data generated.Data) copilot.SessionEvent {
+	t.Helper()
+	return copilot.SessionEvent{Type: generated.SessionEventType(eventType), Data: data}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func float64Ptr(f float64) *float64 {
+	return &f
+}
+
+func TestEventHandler(t *testing.T) {
+	t.Run("attaches usage to final streaming response", func(t *testing.T) {
+		h := &eventHandler{streaming: true}
+
+		var results []eventResult
+		results = append(results, h.handle(newEvent(t, "assistant.message_delta", generated.Data{DeltaContent: strPtr("Hel")}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.message_delta", generated.Data{DeltaContent: strPtr("lo")}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.message", generated.Data{Content: strPtr("Hello")}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.usage", generated.Data{
+			InputTokens:  float64Ptr(12),
+			OutputTokens: float64Ptr(3),
+		}))...)
+		results = append(results, h.handle(newEvent(t, "session.idle", generated.Data{}))...)
+
+		if len(results) != 4 {
+			t.Fatalf("expected 4 results, got %d", len(results))
+		}
+		for i := 0; i < 2; i++ {
+			if !results[i].response.Partial {
+				t.Errorf("result %d: expected partial response", i)
+			}
+			if results[i].response.UsageMetadata != nil {
+				t.Errorf("result %d: expected no usage on partial response", i)
+			}
+		}
+
+		final := results[2].response
+		if final == nil || !final.TurnComplete {
+			t.Fatalf("expected final TurnComplete response, got %+v", results[2])
+		}
+		if final.UsageMetadata == nil {
+			t.Fatal("expected usage metadata on final response")
+		}
+		if final.UsageMetadata.PromptTokenCount != 12 {
+			t.Errorf("expected prompt tokens 12, got %d", final.UsageMetadata.PromptTokenCount)
+		}
+		if final.UsageMetadata.CandidatesTokenCount != 3 {
+			t.Errorf("expected candidates tokens 3, got %d", final.UsageMetadata.CandidatesTokenCount)
+		}
+		if final.UsageMetadata.TotalTokenCount != 15 {
+			t.Errorf("expected total tokens 15, got %d", final.UsageMetadata.TotalTokenCount)
+		}
+
+		if !results[3].done {
+			t.Error("expected done signal after final response")
+		}
+	})
+
+	t.Run("sums usage across model calls", func(t *testing.T) {
+		h := &eventHandler{}
+
+		h.handle(newEvent(t, "assistant.usage", generated.Data{InputTokens: float64Ptr(10), OutputTokens: float64Ptr(2)}))
+		h.handle(newEvent(t, "assistant.message", generated.Data{Content: strPtr("Done")}))
+		h.handle(newEvent(t, "assistant.usage", generated.Data{InputTokens: float64Ptr(20), OutputTokens: float64Ptr(5)}))
+		results := h.handle(newEvent(t, "session.idle", generated.Data{}))
+
+		if len(results) != 2 {
+			t.Fatalf("expected 2 results, got %d", len(results))
+		}
+		usage := results[0].response.UsageMetadata
+		if usage == nil {
+			t.Fatal("expected usage metadata")
+		}
+		if usage.PromptTokenCount != 30 || usage.CandidatesTokenCount != 7 || usage.TotalTokenCount != 37 {
+			t.Errorf("unexpected usage: %+v", usage)
+		}
+	})
+
+	t.Run("reports cached prompt tokens", func(t *testing.T) {
+		h := &eventHandler{}
+
+		h.handle(newEvent(t, "assistant.message", generated.Data{Content: strPtr("Hi")}))
+		h.handle(newEvent(t, "assistant.usage", generated.Data{
+			InputTokens:     float64Ptr(100),
+			OutputTokens:    float64Ptr(5),
+			CacheReadTokens: float64Ptr(80),
+		}))
+		results := h.handle(newEvent(t, "session.idle", generated.Data{}))
+
+		usage := results[0].response.UsageMetadata
+		if usage == nil || usage.CachedContentTokenCount != 80 {
+			t.Fatalf("expected 80 cached tokens, got %+v", usage)
+		}
+		if usage.TotalTokenCount != 105 {
+			t.Errorf("expected cached tokens not to change the total, got %d", usage.TotalTokenCount)
+		}
+	})
+
+	t.Run("records answering model and message ID", func(t *testing.T) {
+		h := &eventHandler{streaming: true}
+
+		var results []eventResult
+		results = append(results, h.handle(newEvent(t, "assistant.message_delta", generated.Data{
+			DeltaContent: strPtr("Hi"),
+			MessageID:    strPtr("msg-1"),
+		}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.message", generated.Data{
+			Content:   strPtr("Hi"),
+			MessageID: strPtr("msg-1"),
+		}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.usage", generated.Data{Model: strPtr("gpt-4o-2024-08-06")}))...)
+		results = append(results, h.handle(newEvent(t, "session.idle", generated.Data{}))...)
+
+		if len(results) != 3 {
+			t.Fatalf("expected 3 results, got %d", len(results))
+		}
+
+		delta := results[0].response
+		if delta.CustomMetadata[MetadataMessageID] != "msg-1" {
+			t.Errorf("expected message ID on delta, got %v", delta.CustomMetadata)
+		}
+
+		final := results[1].response
+		if final.CustomMetadata[MetadataMessageID] != "msg-1" {
+			t.Errorf("expected message ID on final response, got %v", final.CustomMetadata)
+		}
+		if final.CustomMetadata[MetadataModel] != "gpt-4o-2024-08-06" {
+			t.Errorf("expected answering model on final response, got %v", final.CustomMetadata)
+		}
+	})
+
+	t.Run("no usage without usage events", func(t *testing.T) {
+		h := &eventHandler{}
+
+		h.handle(newEvent(t, "assistant.message", generated.Data{Content: strPtr("Hi")}))
+		results := h.handle(newEvent(t, "session.idle", generated.Data{}))
+
+		if len(results) != 2 {
+			t.Fatalf("expected 2 results, got %d", len(results))
+		}
+		if results[0].response.UsageMetadata != nil {
+			t.Errorf("expected nil usage, got %+v", results[0].response.UsageMetadata)
+		}
+		if results[0].response.CustomMetadata != nil {
+			t.Errorf("expected nil metadata, got %v", results[0].response.CustomMetadata)
+		}
+	})
+
+	t.Run("deltas ignored when not streaming", func(t *testing.T) {
+		h := &eventHandler{streaming: false}
+
+		results := h.handle(newEvent(t, "assistant.message_delta", generated.Data{DeltaContent: strPtr("Hel")}))
+		if len(results) != 0 {
+			t.Errorf("expected no results, got %d", len(results))
+		}
+	})
+
+	t.Run("streaming reasoning as thought parts", func(t *testing.T) {
+		h := &eventHandler{streaming: true}
+
+		var results []eventResult
+		results = append(results, h.handle(newEvent(t, "assistant.reasoning_delta", generated.Data{DeltaContent: strPtr("Thinking")}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.reasoning", generated.Data{Content: strPtr("Thinking")}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.message_delta", generated.Data{DeltaContent: strPtr("Answer")}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.message", generated.Data{Content: strPtr("Answer")}))...)
+		results = append(results, h.handle(newEvent(t, "session.idle", generated.Data{}))...)
+
+		if len(results) != 4 {
+			t.Fatalf("expected 4 results, got %d", len(results))
+		}
+
+		delta := results[0].response
+		if !delta.Partial || len(delta.Content.Parts) != 1 || !delta.Content.Parts[0].Thought {
+			t.Errorf("expected partial thought part, got %+v", delta)
+		}
+		if results[1].response.Content.Parts[0].Thought {
+			t.Error("expected message delta not to be a thought")
+		}
+
+		parts := results[2].response.Content.Parts
+		if len(parts) != 2 {
+			t.Fatalf("expected thought and text parts on final response, got %d", len(parts))
+		}
+		if !parts[0].Thought || parts[0].Text != "Thinking" {
+			t.Errorf("expected first part to be the thought, got %+v", parts[0])
+		}
+		if parts[1].Thought || parts[1].Text != "Answer" {
+			t.Errorf("expected second part to be the answer, got %+v", parts[1])
+		}
+	})
+
+	t.Run("non-streaming reasoning", func(t *testing.T) {
+		h := &eventHandler{}
+
+		var results []eventResult
+		results = append(results, h.handle(newEvent(t, "assistant.reasoning_delta", generated.Data{DeltaContent: strPtr("Hmm")}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.reasoning", generated.Data{Content: strPtr("Hmm")}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.message", generated.Data{}))...)
+		results = append(results, h.handle(newEvent(t, "session.idle", generated.Data{}))...)
+
+		if len(results) != 2 {
+			t.Fatalf("expected 2 results, got %d", len(results))
+		}
+		content := results[0].response.Content
+		if content == nil || len(content.Parts) != 1 || !content.Parts[0].Thought {
+			t.Fatalf("expected a single thought part, got %+v", content)
+		}
+	})
+
+	t.Run("tool request message is not terminal", func(t *testing.T) {
+		h := &eventHandler{}
+		toolRequests := []generated.ToolRequest{{Name: "calculator", ToolCallID: "call-1"}}
+
+		var results []eventResult
+		results = append(results, h.handle(newEvent(t, "assistant.message", generated.Data{
+			Content:      strPtr("Let me calculate that."),
+			ToolRequests: toolRequests,
+		}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.message", generated.Data{ToolRequests: toolRequests}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.message", generated.Data{Content: strPtr("The answer is 5.")}))...)
+		results = append(results, h.handle(newEvent(t, "session.idle", generated.Data{}))...)
+
+		if len(results) != 3 {
+			t.Fatalf("expected 3 results, got %d", len(results))
+		}
+
+		preamble := results[0].response
+		if preamble.TurnComplete {
+			t.Error("expected tool-calling message not to complete the turn")
+		}
+		if preamble.FinishReason != genai.FinishReasonUnspecified {
+			t.Errorf("expected unspecified finish reason, got %q", preamble.FinishReason)
+		}
+		if preamble.Content.Parts[0].Text != "Let me calculate that." {
+			t.Errorf("unexpected preamble text %q", preamble.Content.Parts[0].Text)
+		}
+
+		final := results[1].response
+		if !final.TurnComplete || final.FinishReason != genai.FinishReasonStop {
+			t.Errorf("expected terminal final response, got %+v", final)
+		}
+		if final.Content.Parts[0].Text != "The answer is 5." {
+			t.Errorf("unexpected final text %q", final.Content.Parts[0].Text)
+		}
+
+		if !results[2].done {
+			t.Error("expected done signal")
+		}
+	})
+
+	t.Run("idle without message reports empty response", func(t *testing.T) {
+		h := &eventHandler{streaming: true}
+
+		h.handle(newEvent(t, "assistant.usage", generated.Data{InputTokens: float64Ptr(4)}))
+		results := h.handle(newEvent(t, "session.idle", generated.Data{}))
+
+		if len(results) != 2 {
+			t.Fatalf("expected 2 results, got %d", len(results))
+		}
+		resp := results[0].response
+		if resp == nil || !resp.TurnComplete {
+			t.Fatalf("expected terminal response, got %+v", results[0])
+		}
+		if resp.FinishReason != genai.FinishReasonOther {
+			t.Errorf("expected FinishReasonOther, got %q", resp.FinishReason)
+		}
+		if resp.Content != nil {
+			t.Errorf("expected nil content, got %+v", resp.Content)
+		}
+		if resp.ErrorMessage == "" {
+			t.Error("expected an error message")
+		}
+		if resp.UsageMetadata == nil || resp.UsageMetadata.PromptTokenCount != 4 {
+			t.Errorf("expected usage to be attached, got %+v", resp.UsageMetadata)
+		}
+		if !results[1].done {
+			t.Error("expected done signal")
+		}
+	})
+
+	t.Run("idle after only tool requests reports empty response", func(t *testing.T) {
+		h := &eventHandler{}
+
+		h.handle(newEvent(t, "assistant.message", generated.Data{
+			ToolRequests: []generated.ToolRequest{{Name: "calculator", ToolCallID: "call-1"}},
+		}))
+		results := h.handle(newEvent(t, "session.idle", generated.Data{}))
+
+		if len(results) != 2 || results[0].response == nil || results[0].response.FinishReason != genai.FinishReasonOther {
+			t.Fatalf("expected empty terminal response, got %+v", results)
+		}
+	})
+
+	t.Run("session error", func(t *testing.T) {
+		h := &eventHandler{}
+
+		results := h.handle(newEvent(t, "session.error", generated.Data{Content: strPtr("boom")}))
+		if len(results) != 1 || results[0].err == nil {
+			t.Fatalf("expected a single error result, got %+v", results)
+		}
+		if results[0].err.Error() != "session error: boom" {
+			t.Errorf("unexpected error message: %v", results[0].err)
+		}
+	})
+
+	t.Run("estimates missing usage when enabled", func(t *testing.T) {
+		h := &eventHandler{promptTokens: estimateTokens("User: What is two plus two?")}
+
+		h.handle(newEvent(t, "assistant.message", generated.Data{Content: strPtr("Four.")}))
+		results := h.handle(newEvent(t, "session.idle", generated.Data{}))
+
+		final := results[0].response
+		want := &genai.GenerateContentResponseUsageMetadata{PromptTokenCount: 7, CandidatesTokenCount: 2, TotalTokenCount: 9}
+		if !reflect.DeepEqual(final.UsageMetadata, want) {
+			t.Errorf("expected estimated usage %+v, got %+v", want, final.UsageMetadata)
+		}
+		if final.CustomMetadata[MetadataUsageEstimated] != true {
+			t.Errorf("expected usage to be marked as estimated, got %v", final.CustomMetadata)
+		}
+	})
+
+	t.Run("reported usage is not estimated", func(t *testing.T) {
+		h := &eventHandler{promptTokens: estimateTokens("User: What is two plus two?")}
+
+		h.handle(newEvent(t, "assistant.message", generated.Data{Content: strPtr("Four.")}))
+		h.handle(newEvent(t, "assistant.usage", generated.Data{InputTokens: float64Ptr(20), OutputTokens: float64Ptr(1)}))
+		results := h.handle(newEvent(t, "session.idle", generated.Data{}))
+
+		final := results[0].response
+		if final.UsageMetadata.PromptTokenCount != 20 {
+			t.Errorf("expected reported usage, got %+v", final.UsageMetadata)
+		}
+		if _, ok := final.CustomMetadata[MetadataUsageEstimated]; ok {
+			t.Error("expected reported usage not to be marked as estimated")
+		}
+	})
+
+	t.Run("reports trimmed history", func(t *testing.T) {
+		h := &eventHandler{trimmed: 3}
+
+		h.handle(newEvent(t, "assistant.message", generated.Data{Content: strPtr("Four.")}))
+		results := h.handle(newEvent(t, "session.idle", generated.Data{}))
+
+		if got := results[0].response.CustomMetadata[MetadataTrimmedContents]; got != 3 {
+			t.Errorf("expected 3 trimmed contents in metadata, got %v", got)
+		}
+	})
+
+	t.Run("reports request and session IDs", func(t *testing.T) {
+		h := &eventHandler{requestID: "req-1", sessionID: "session-1"}
+
+		h.handle(newEvent(t, "assistant.message", generated.Data{Content: strPtr("Four.")}))
+		results := h.handle(newEvent(t, "session.idle", generated.Data{}))
+
+		metadata := results[0].response.CustomMetadata
+		if metadata[MetadataRequestID] != "req-1" || metadata[MetadataSessionID] != "session-1" {
+			t.Errorf("expected request and session IDs in metadata, got %v", metadata)
+		}
+	})
+
+	t.Run("second final message supersedes the first", func(t *testing.T) {
+		h := &eventHandler{}
+
+		var results []eventResult
+		results = append(results, h.handle(newEvent(t, "assistant.message", generated.Data{Content: strPtr("First")}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.message", generated.Data{Content: strPtr("Second")}))...)
+		results = append(results, h.handle(newEvent(t, "session.idle", generated.Data{}))...)
+
+		if len(results) != 3 {
+			t.Fatalf("expected flushed, final and done results, got %d", len(results))
+		}
+		first, final := results[0].response, results[1].response
+		if extractText(first.Content) != "First" || first.TurnComplete || first.FinishReason != genai.FinishReasonUnspecified {
+			t.Errorf("expected the first message flushed as non-terminal, got %+v", first)
+		}
+		if extractText(final.Content) != "Second" || !final.TurnComplete || final.FinishReason != genai.FinishReasonStop {
+			t.Errorf("expected the second message to end the turn, got %+v", final)
+		}
+		if !results[2].done {
+			t.Error("expected the last result to signal done")
+		}
+	})
+
+	t.Run("content-less final message ends the turn once", func(t *testing.T) {
+		h := &eventHandler{streaming: true}
+
+		var results []eventResult
+		results = append(results, h.handle(newEvent(t, "assistant.message_delta", generated.Data{DeltaContent: strPtr("Hel")}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.message_delta", generated.Data{DeltaContent: strPtr("lo")}))...)
+		results = append(results, h.handle(newEvent(t, "assistant.message", generated.Data{}))...)
+		results = append(results, h.handle(newEvent(t, "session.idle", generated.Data{}))...)
+
+		var terminal []*model.LLMResponse
+		for _, result := range results {
+			if result.response != nil && result.response.TurnComplete {
+				terminal = append(terminal, result.response)
+			}
+		}
+		if len(terminal) != 1 {
+			t.Fatalf("expected exactly one TurnComplete response, got %d", len(terminal))
+		}
+		if terminal[0].Content != nil || terminal[0].FinishReason != genai.FinishReasonStop || terminal[0].ErrorMessage != "" {
+			t.Errorf("expected a clean finish-only response, got %+v", terminal[0])
+		}
+		if !results[len(results)-1].done {
+			t.Error("expected the final result to signal done")
+		}
+
+		// The streamed text survives the empty final message
+		collected, err := CollectStream(responseSeq(t, nil, results[0].response, results[1].response, terminal[0]))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := collected.Content.Parts[0].Text; got != "Hello" || collected.FinishReason != genai.FinishReasonStop {
+			t.Errorf("expected 'Hello' with stop finish reason, got %q (%q)", got, collected.FinishReason)
+		}
+	})
+
+	t.Run("accumulates streamed text", func(t *testing.T) {
+		h := &eventHandler{streaming: true, accumulate: true}
+
+		var texts []string
+		for _, event := range []copilot.SessionEvent{
+			newEvent(t, "assistant.reasoning_delta", generated.Data{DeltaContent: strPtr("Think")}),
+			newEvent(t, "assistant.reasoning_delta", generated.Data{DeltaContent: strPtr("ing")}),
+			newEvent(t, "assistant.message_delta", generated.Data{DeltaContent: strPtr("Hel")}),
+			newEvent(t, "assistant.message_delta", generated.Data{DeltaContent: strPtr("lo")}),
+			newEvent(t, "assistant.message", generated.Data{Content: strPtr("Hello")}),
+			newEvent(t, "assistant.message_delta", generated.Data{DeltaContent: strPtr("Next")}),
+		} {
+			for _, result := range h.handle(event) {
+				texts = append(texts, result.response.Content.Parts[0].Text)
+			}
+		}
+
+		// The completed message resets accumulation for the next one
+		want := []string{"Think", "Thinking", "Hel", "Hello", "Next"}
+		if !reflect.DeepEqual(texts, want) {
+			t.Errorf("expected %q, got %q", want, texts)
+		}
+	})
+
+	t.Run("missing usage left nil by default", func(t *testing.T) {
+		h := &eventHandler{}
+
+		h.handle(newEvent(t, "assistant.message", generated.Data{Content: strPtr("Four.")}))
+		results := h.handle(newEvent(t, "session.idle", generated.Data{}))
+
+		if results[0].response.UsageMetadata != nil {
+			t.Errorf("expected no usage, got %+v", results[0].response.UsageMetadata)
+		}
+	})
+}
+
+// responseSeq returns an iterator yielding the given responses, then err if non-nil.
+func responseSeq(t *testing.T, err error, responses ...*model.LLMResponse) iter.Seq2[*model.LLMResponse, error] {
+	t.Helper()
+	return func(yield func(*model.LLMResponse, error) bool) {
+		for _, resp := range responses {
+			if !yield(resp, nil) {
+				return
+			}
+		}
+		if err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+func textResponse(text string, partial bool) *model.LLMResponse {
+	return &model.LLMResponse{
+		Content: &genai.Content{Role: "model", Parts: []*genai.Part{genai.NewPartFromText(text)}},
+		Partial: partial,
+	}
+}
+
+func TestCollectStream(t *testing.T) {
+	t.Run("concatenates partial deltas", func(t *testing.T) {
+		usage := &genai.GenerateContentResponseUsageMetadata{TotalTokenCount: 9}
+		resp, err := CollectStream(responseSeq(t, nil,
+			textResponse("Hel", true),
+			textResponse("lo", true),
+			&model.LLMResponse{TurnComplete: true, FinishReason: genai.FinishReasonStop, UsageMetadata: usage},
+		))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if got := extractText(resp.Content); got != "Hello" {
+			t.Errorf("expected text 'Hello', got %q", got)
+		}
+		if resp.FinishReason != genai.FinishReasonStop {
+			t.Errorf("expected FinishReasonStop, got %q", resp.FinishReason)
+		}
+		if resp.UsageMetadata != usage {
+			t.Errorf("expected usage to be carried through, got %+v", resp.UsageMetadata)
+		}
+		if resp.Partial || !resp.TurnComplete {
+			t.Errorf("expected a complete response, got %+v", resp)
+		}
+	})
+
+	t.Run("complete message supersedes deltas", func(t *testing.T) {
+		final := textResponse("Hello", false)
+		final.TurnComplete = true
+		final.FinishReason = genai.FinishReasonStop
+
+		resp, err := CollectStream(responseSeq(t, nil,
+			textResponse("Hel", true),
+			textResponse("lo", true),
+			final,
+		))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if got := extractText(resp.Content); got != "Hello" {
+			t.Errorf("expected text 'Hello', got %q", got)
+		}
+	})
+
+	t.Run("keeps thoughts separate", func(t *testing.T) {
+		thought := &model.LLMResponse{
+			Content: &genai.Content{Role: "model", Parts: []*genai.Part{{Text: "Hmm", Thought: true}}},
+			Partial: true,
+		}
+		resp, err := CollectStream(responseSeq(t, nil,
+			thought,
+			textResponse("Answer", true),
+			&model.LLMResponse{TurnComplete: true},
+		))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		parts := resp.Content.Parts
+		if len(parts) != 2 || !parts[0].Thought || parts[0].Text != "Hmm" || parts[1].Text != "Answer" {
+			t.Errorf("unexpected parts: %+v", parts)
+		}
+	})
+
+	t.Run("expects deltas", func(t *testing.T) {
+		// BatchGenerate collects a delta stream whatever StreamAccumulate is,
+		// because a content-less final message leaves the partials in place
+		collect := func(accumulate bool) string {
+			h := &eventHandler{streaming: true, accumulate: accumulate}
+			var responses []*model.LLMResponse
+			for _, event := range []copilot.SessionEvent{
+				newEvent(t, "assistant.message_delta", generated.Data{DeltaContent: strPtr("Hel")}),
+				newEvent(t, "assistant.message_delta", generated.Data{DeltaContent: strPtr("lo")}),
+				newEvent(t, "assistant.message", generated.Data{}),
+				newEvent(t, "session.idle", generated.Data{}),
+			} {
+				for _, result := range h.handle(event) {
+					if result.response != nil {
+						responses = append(responses, result.response)
+					}
+				}
+			}
+			resp, err := CollectStream(responseSeq(t, nil, responses...))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			return extractText(resp.Content)
+		}
+
+		if got := collect(false); got != "Hello" {
+			t.Errorf("expected deltas to collect to 'Hello', got %q", got)
+		}
+		if got := collect(true); got != "HelHello" {
+			t.Errorf("expected accumulated partials to repeat text, got %q", got)
+		}
+	})
+
+	t.Run("returns first error", func(t *testing.T) {
+		wantErr := errors.New("stream failed")
+		resp, err := CollectStream(responseSeq(t, wantErr, textResponse("Hel", true)))
+		if !errors.Is(err, wantErr) {
+			t.Fatalf("expected %v, got %v", wantErr, err)
+		}
+		if resp != nil {
+			t.Errorf("expected nil response on error, got %+v", resp)
+		}
+	})
+
+	t.Run("empty stream", func(t *testing.T) {
+		resp, err := CollectStream(responseSeq(t, nil))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp.Content != nil {
+			t.Errorf("expected nil content, got %+v", resp.Content)
+		}
+	})
+}
+
+func TestWarnUnsupportedConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      *genai.GenerateContentConfig
+		wantWarn bool
+	}{
+		{
+			name:     "nil config",
+			cfg:      nil,
+			wantWarn: false,
+		},
+		{
+			name:     "no unsupported settings",
+			cfg:      &genai.GenerateContentConfig{},
+			wantWarn: false,
+		},
+		{
+			name: "safety settings ignored",
+			cfg: &genai.GenerateContentConfig{
+				SafetySettings: []*genai.SafetySetting{{
+					Category:  genai.HarmCategoryHarassment,
+					Threshold: genai.HarmBlockThresholdBlockLowAndAbove,
+				}},
+			},
+			wantWarn: true,
+		},
+		{
+			name:     "max output tokens ignored",
+			cfg:      &genai.GenerateContentConfig{MaxOutputTokens: 256},
+			wantWarn: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+			warnUnsupportedConfig(logger, tt.cfg)
+
+			gotWarn := strings.Contains(buf.String(), "level=WARN")
+			if gotWarn != tt.wantWarn {
+				t.Errorf("expected warning %v, got log %q", tt.wantWarn, buf.String())
+			}
+		})
+	}
+}
+
+// flushRecorder records writes and flushes for writer tests.
+type flushRecorder struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (f *flushRecorder) Flush() error {
+	f.flushes++
+	return nil
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestTeeToWriter(t *testing.T) {
+	t.Run("writes deltas and skips duplicate final text", func(t *testing.T) {
+		thought := &model.LLMResponse{
+			Content: &genai.Content{Role: "model", Parts: []*genai.Part{{Text: "Hmm", Thought: true}}},
+			Partial: true,
+		}
+		final := textResponse("Hello", false)
+		final.TurnComplete = true
+		final.FinishReason = genai.FinishReasonStop
+
+		var w flushRecorder
+		resp, err := CollectStream(teeToWriter(responseSeq(t, nil,
+			thought,
+			textResponse("Hel", true),
+			textResponse("lo", true),
+			final,
+		), &w))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if w.String() != "Hello" {
+			t.Errorf("expected written text 'Hello', got %q", w.String())
+		}
+		if w.flushes != 2 {
+			t.Errorf("expected 2 flushes, got %d", w.flushes)
+		}
+		if extractText(resp.Content) != "Hello" || resp.FinishReason != genai.FinishReasonStop {
+			t.Errorf("unexpected aggregated response: %+v", resp)
+		}
+	})
+
+	t.Run("writes complete messages without deltas", func(t *testing.T) {
+		final := textResponse("The answer is 5.", false)
+		final.TurnComplete = true
+
+		var w bytes.Buffer
+		_, err := CollectStream(teeToWriter(responseSeq(t, nil,
+			textResponse("Let me check. ", false),
+			final,
+		), &w))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if w.String() != "Let me check. The answer is 5." {
+			t.Errorf("unexpected written text %q", w.String())
+		}
+	})
+
+	t.Run("writes complete message after thought-only deltas", func(t *testing.T) {
+		thought := &model.LLMResponse{
+			Content: &genai.Content{Role: "model", Parts: []*genai.Part{{Text: "Hmm", Thought: true}}},
+			Partial: true,
+		}
+		final := textResponse("Hello", false)
+		final.TurnComplete = true
+
+		var w bytes.Buffer
+		_, err := CollectStream(teeToWriter(responseSeq(t, nil, thought, thought, final), &w))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if w.String() != "Hello" {
+			t.Errorf("expected written text 'Hello', got %q", w.String())
+		}
+	})
+
+	t.Run("writes text of dropped deltas from the complete message", func(t *testing.T) {
+		final := textResponse("Hello, world", false)
+		final.TurnComplete = true
+
+		var w bytes.Buffer
+		_, err := CollectStream(teeToWriter(responseSeq(t, nil,
+			textResponse("Hel", true),
+			// "lo, " was dropped before reaching the writer
+			textResponse("wor", true),
+			final,
+		), &w))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// The written prefix no longer matches, so the full text follows it
+		if w.String() != "HelworHello, world" {
+			t.Errorf("unexpected written text %q", w.String())
+		}
+	})
+
+	t.Run("writes the missing suffix from the complete message", func(t *testing.T) {
+		final := textResponse("Hello, world", false)
+		final.TurnComplete = true
+
+		var w bytes.Buffer
+		_, err := CollectStream(teeToWriter(responseSeq(t, nil,
+			textResponse("Hel", true),
+			textResponse("lo", true),
+			// ", world" was dropped before reaching the writer
+			final,
+		), &w))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if w.String() != "Hello, world" {
+			t.Errorf("expected written text 'Hello, world', got %q", w.String())
+		}
+	})
+
+	t.Run("write error", func(t *testing.T) {
+		_, err := CollectStream(teeToWriter(responseSeq(t, nil, textResponse("Hi", true)), failingWriter{}))
+		if err == nil || !strings.Contains(err.Error(), "disk full") {
+			t.Errorf("expected write error, got %v", err)
+		}
+	})
+}
+
+// fakeSession records aborts for forwardEvents tests.
+type fakeSession struct {
+	aborts int
+}
+
+func (f *fakeSession) Abort() error {
+	f.aborts++
+	return nil
+}
+
+// collectForwarded runs forwardEvents and returns what it yielded.
+func collectForwarded(t *testing.T, ctx context.Context, session aborter, eventCh <-chan eventResult, idleTimeout time.Duration) ([]*model.LLMResponse, error) {
+	t.Helper()
+	var responses []*model.LLMResponse
+	var lastErr error
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	forwardEvents(ctx, session, eventCh, nil, nil, nil, idleTimeout, logger, func(resp *model.LLMResponse, err error) bool {
+		if err != nil {
+			lastErr = err
+			return false
+		}
+		responses = append(responses, resp)
+		return true
+	})
+	return responses, lastErr
+}
+
+func TestEventCallback(t *testing.T) {
+	t.Run("passes raw events to OnSessionEvent", func(t *testing.T) {
+		var seen []string
+		llm, err := New(Config{OnSessionEvent: func(event copilot.SessionEvent) {
+			seen = append(seen, string(event.Type))
+		}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		eventCh := make(chan eventResult, 4)
+		finalCh := make(chan eventResult, 2)
+		callback := llm.eventCallback(&eventHandler{}, eventCh, finalCh, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		callback(newEvent(t, "assistant.usage", generated.Data{InputTokens: float64Ptr(1)}))
+		callback(newEvent(t, "assistant.message", generated.Data{Content: strPtr("Hi")}))
+		callback(newEvent(t, "session.idle", generated.Data{}))
+
+		if want := []string{"assistant.usage", "assistant.message", "session.idle"}; !reflect.DeepEqual(seen, want) {
+			t.Errorf("expected events %v, got %v", want, seen)
+		}
+		// Without an idle timeout only idle produces results: the response and done
+		if len(eventCh) != 0 || len(finalCh) != 2 {
+			t.Errorf("expected 2 terminal results, got %d results and %d terminal", len(eventCh), len(finalCh))
+		}
+	})
+
+	t.Run("signals activity only when enabled", func(t *testing.T) {
+		llm, err := New(Config{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		eventCh := make(chan eventResult, 4)
+		activity := make(chan struct{}, 1)
+		callback := llm.eventCallback(&eventHandler{}, eventCh, make(chan eventResult, 2), activity, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		callback(newEvent(t, "assistant.usage", generated.Data{InputTokens: float64Ptr(1)}))
+		callback(newEvent(t, "assistant.usage", generated.Data{InputTokens: float64Ptr(1)}))
+
+		if len(activity) != 1 {
+			t.Errorf("expected a single pending activity signal, got %d", len(activity))
+		}
+		if len(eventCh) != 0 {
+			t.Errorf("expected activity to stay out of the result channel, got %d results", len(eventCh))
+		}
+	})
+
+	t.Run("full result channel does not block", func(t *testing.T) {
+		llm, err := New(Config{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		eventCh := make(chan eventResult)
+		finalCh := make(chan eventResult, 2)
+		callback := llm.eventCallback(&eventHandler{streaming: true}, eventCh, finalCh, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+		returned := make(chan struct{})
+		go func() {
+			defer close(returned)
+			callback(newEvent(t, "assistant.message_delta", generated.Data{DeltaContent: strPtr("Hel")}))
+			callback(newEvent(t, "assistant.message", generated.Data{Content: strPtr("Hello")}))
+			callback(newEvent(t, "session.idle", generated.Data{}))
+			callback(newEvent(t, "session.error", generated.Data{Content: strPtr("late")}))
+		}()
+		select {
+		case <-returned:
+		case <-time.After(2 * time.Second):
+			t.Fatal("callback blocked on a full result channel")
+		}
+
+		// The final response and done are kept; the late error is not
+		final, done := <-finalCh, <-finalCh
+		if final.response == nil || !final.response.TurnComplete || !done.done {
+			t.Errorf("expected final response then done, got %+v and %+v", final, done)
+		}
+		if len(finalCh) != 0 {
+			t.Errorf("expected nothing after done, got %d results", len(finalCh))
+		}
+	})
+
+	t.Run("logs dropped results", func(t *testing.T) {
+		llm, err := New(Config{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var logs bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		callback := llm.eventCallback(&eventHandler{streaming: true}, make(chan eventResult), make(chan eventResult, 2), nil, logger)
+		callback(newEvent(t, "assistant.message_delta", generated.Data{DeltaContent: strPtr("Hi")}))
+
+		if !strings.Contains(logs.String(), "dropping session event result") {
+			t.Errorf("expected dropped result to be logged, got %q", logs.String())
+		}
+	})
+}
+
+func TestForwardEvents(t *testing.T) {
+	t.Run("forwards queued results before the final response", func(t *testing.T) {
+		eventCh := make(chan eventResult, 4)
+		finalCh := make(chan eventResult, 2)
+		eventCh <- eventResult{response: textResponse("Hel", true)}
+		eventCh <- eventResult{response: textResponse("lo", true)}
+		finalCh <- eventResult{response: &model.LLMResponse{TurnComplete: true}}
+		finalCh <- eventResult{done: true}
+
+		var responses []*model.LLMResponse
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		forwardEvents(context.Background(), &fakeSession{}, eventCh, finalCh, nil, nil, 0, logger, func(resp *model.LLMResponse, err error) bool {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			responses = append(responses, resp)
+			return true
+		})
+
+		if len(responses) != 3 || !responses[0].Partial || !responses[1].Partial || !responses[2].TurnComplete {
+			t.Errorf("expected both deltas before the final response, got %+v", responses)
+		}
+	})
+
+	t.Run("forwards responses until done", func(t *testing.T) {
+		eventCh := make(chan eventResult, 4)
+		eventCh <- eventResult{response: textResponse("Hel", true)}
+		eventCh <- eventResult{response: textResponse("Hello", false)}
+		eventCh <- eventResult{done: true}
+
+		session := &fakeSession{}
+		responses, err := collectForwarded(t, context.Background(), session, eventCh, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(responses) != 2 {
+			t.Errorf("expected 2 responses, got %d", len(responses))
+		}
+		if session.aborts != 0 {
+			t.Errorf("expected no abort, got %d", session.aborts)
+		}
+	})
+
+	t.Run("slow response not aborted without timeout", func(t *testing.T) {
+		llm, err := New(Config{RequestTimeout: -1})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ctx, cancel := llm.requestContext(context.Background(), false)
+		defer cancel()
+
+		eventCh := make(chan eventResult, 2)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			eventCh <- eventResult{response: textResponse("Hello", false)}
+			eventCh <- eventResult{done: true}
+		}()
+
+		session := &fakeSession{}
+		responses, err := collectForwarded(t, ctx, session, eventCh, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(responses) != 1 || session.aborts != 0 {
+			t.Errorf("expected 1 response and no abort, got %d responses and %d aborts", len(responses), session.aborts)
+		}
+	})
+
+	t.Run("cancelled context aborts session", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		session := &fakeSession{}
+		_, err := collectForwarded(t, ctx, session, make(chan eventResult), 0)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+		if session.aborts != 1 {
+			t.Errorf("expected 1 abort, got %d", session.aborts)
+		}
+	})
+
+	t.Run("stalled stream times out", func(t *testing.T) {
+		eventCh := make(chan eventResult, 1)
+		eventCh <- eventResult{response: textResponse("Hel", true)}
+
+		session := &fakeSession{}
+		start := time.Now()
+		responses, err := collectForwarded(t, context.Background(), session, eventCh, 20*time.Millisecond)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected idle timeout error, got %v", err)
+		}
+		if len(responses) != 1 {
+			t.Errorf("expected the response before the stall, got %d", len(responses))
+		}
+		if session.aborts != 1 {
+			t.Errorf("expected 1 abort, got %d", session.aborts)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("idle timeout took too long: %v", elapsed)
+		}
+	})
+
+	t.Run("slow consumer is not an idle stream", func(t *testing.T) {
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		for run := 0; run < 20; run++ {
+			eventCh := make(chan eventResult, 4)
+			eventCh <- eventResult{response: textResponse("Hel", true)}
+			eventCh <- eventResult{response: textResponse("lo", true)}
+			eventCh <- eventResult{response: textResponse("Hello", false)}
+			eventCh <- eventResult{done: true}
+
+			session := &fakeSession{}
+			var lastErr error
+			forwardEvents(context.Background(), session, eventCh, nil, nil, nil, 5*time.Millisecond, logger, func(_ *model.LLMResponse, err error) bool {
+				if err != nil {
+					lastErr = err
+					return false
+				}
+				time.Sleep(10 * time.Millisecond)
+				return true
+			})
+			if lastErr != nil || session.aborts != 0 {
+				t.Fatalf("run %d: expected no idle abort with queued results, got %v (%d aborts)", run, lastErr, session.aborts)
+			}
+		}
+	})
+
+	t.Run("activity resets idle timer", func(t *testing.T) {
+		eventCh := make(chan eventResult, 1)
+		activity := make(chan struct{})
+		go func() {
+			for i := 0; i < 5; i++ {
+				time.Sleep(10 * time.Millisecond)
+				activity <- struct{}{}
+			}
+			eventCh <- eventResult{done: true}
+		}()
+
+		var lastErr error
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		forwardEvents(context.Background(), &fakeSession{}, eventCh, nil, activity, nil, 40*time.Millisecond, logger, func(_ *model.LLMResponse, err error) bool {
+			lastErr = err
+			return err == nil
+		})
+		if lastErr != nil {
+			t.Errorf("expected no idle timeout while events arrive, got %v", lastErr)
+		}
+	})
+}
+
+func TestRunBatch(t *testing.T) {
+	t.Run("results aligned with inputs", func(t *testing.T) {
+		var mu sync.Mutex
+		active, maxActive := 0, 0
+
+		responses, errs := runBatch(context.Background(), 10, 3, func(ctx context.Context, i int) (*model.LLMResponse, error) {
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				active--
+				mu.Unlock()
+			}()
+
+			time.Sleep(5 * time.Millisecond)
+			if i == 4 {
+				return nil, fmt.Errorf("request %d failed", i)
+			}
+			return textResponse(fmt.Sprintf("answer %d", i), false), nil
+		})
+
+		if maxActive > 3 {
+			t.Errorf("expected at most 3 concurrent requests, got %d", maxActive)
+		}
+		for i := 0; i < 10; i++ {
+			if i == 4 {
+				if errs[i] == nil || responses[i] != nil {
+					t.Errorf("request 4: expected error only, got %v, %v", responses[i], errs[i])
+				}
+				continue
+			}
+			if errs[i] != nil {
+				t.Errorf("request %d: unexpected error: %v", i, errs[i])
+				continue
+			}
+			if got := extractText(responses[i].Content); got != fmt.Sprintf("answer %d", i) {
+				t.Errorf("request %d: got misaligned response %q", i, got)
+			}
+		}
+	})
+
+	t.Run("cancelled context skips remaining requests", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		calls := 0
+		_, errs := runBatch(ctx, 3, 1, func(ctx context.Context, i int) (*model.LLMResponse, error) {
+			calls++
+			return nil, ctx.Err()
+		})
+
+		for i, err := range errs {
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("request %d: expected context.Canceled, got %v", i, err)
+			}
+		}
+		if calls > 1 {
+			t.Errorf("expected at most one request to start, got %d", calls)
+		}
+	})
+
+	t.Run("non-positive concurrency runs serially", func(t *testing.T) {
+		responses, errs := runBatch(context.Background(), 2, 0, func(ctx context.Context, i int) (*model.LLMResponse, error) {
+			return textResponse("ok", false), nil
+		})
+		if len(responses) != 2 || errs[0] != nil || errs[1] != nil {
+			t.Errorf("unexpected results: %v, %v", responses, errs)
+		}
+	})
+}
+
+// recordingSpan captures attributes and errors for tracing tests.
+type recordingSpan struct {
+	trace.Span
+	attrs  map[attribute.Key]attribute.Value
+	errs   []error
+	status codes.Code
+}
+
+func newRecordingSpan() *recordingSpan {
+	_, span := noop.NewTracerProvider().Tracer("").Start(context.Background(), "test")
+	return &recordingSpan{Span: span, attrs: make(map[attribute.Key]attribute.Value)}
+}
+
+func (r *recordingSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, attr := range kv {
+		r.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (r *recordingSpan) RecordError(err error, _ ...trace.EventOption) {
+	r.errs = append(r.errs, err)
+}
+
+func (r *recordingSpan) SetStatus(code codes.Code, _ string) {
+	r.status = code
+}
+
+func TestTraceYield(t *testing.T) {
+	t.Run("records terminal response", func(t *testing.T) {
+		span := newRecordingSpan()
+		yield := traceYield(span, func(*model.LLMResponse, error) bool { return true })
+
+		yield(textResponse("Hel", true), nil)
+		if len(span.attrs) != 0 {
+			t.Errorf("expected no attributes for partial response, got %v", span.attrs)
+		}
+
+		yield(&model.LLMResponse{
+			TurnComplete:   true,
+			FinishReason:   genai.FinishReasonStop,
+			CustomMetadata: map[string]any{MetadataModel: "gpt-4o"},
+			UsageMetadata:  &genai.GenerateContentResponseUsageMetadata{PromptTokenCount: 10, CandidatesTokenCount: 4},
+		}, nil)
+
+		if got := span.attrs["gen_ai.response.finish_reasons"].AsStringSlice(); !reflect.DeepEqual(got, []string{"STOP"}) {
+			t.Errorf("unexpected finish reasons %v", got)
+		}
+		if got := span.attrs["gen_ai.response.model"].AsString(); got != "gpt-4o" {
+			t.Errorf("unexpected response model %q", got)
+		}
+		if got := span.attrs["gen_ai.usage.input_tokens"].AsInt64(); got != 10 {
+			t.Errorf("unexpected input tokens %d", got)
+		}
+		if got := span.attrs["gen_ai.usage.output_tokens"].AsInt64(); got != 4 {
+			t.Errorf("unexpected output tokens %d", got)
+		}
+		if span.status != codes.Unset {
+			t.Errorf("expected unset status, got %v", span.status)
+		}
+	})
+
+	t.Run("records errors", func(t *testing.T) {
+		span := newRecordingSpan()
+		yield := traceYield(span, func(*model.LLMResponse, error) bool { return false })
+
+		if yield(nil, errors.New("boom")) {
+			t.Error("expected wrapped yield result to be passed through")
+		}
+		if len(span.errs) != 1 || span.status != codes.Error {
+			t.Errorf("expected recorded error, got %v (status %v)", span.errs, span.status)
+		}
+	})
+}
+
+func TestDefaultTracer(t *testing.T) {
+	llm, err := New(Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if llm.config.Tracer == nil {
+		t.Fatal("expected a no-op tracer by default")
+	}
+	_, span := llm.config.Tracer.Start(context.Background(), "test")
+	if span.IsRecording() {
+		t.Error("expected default tracer spans not to record")
+	}
+}
+
+// recordingMetrics records every measurement it receives.
+type recordingMetrics struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	prompt    int
+	output    int
+	errors    []string
+}
+
+func (m *recordingMetrics) ObserveLatency(model string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.latencies == nil {
+		m.latencies = make(map[string][]time.Duration)
+	}
+	m.latencies[model] = append(m.latencies[model], d)
+}
+
+func (m *recordingMetrics) AddTokens(prompt, completion int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prompt += prompt
+	m.output += completion
+}
+
+func (m *recordingMetrics) IncError(kind string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors = append(m.errors, kind)
+}
+
+func TestMetricsYield(t *testing.T) {
+	pass := func(*model.LLMResponse, error) bool { return true }
+
+	t.Run("records terminal response", func(t *testing.T) {
+		metrics := &recordingMetrics{}
+		clock := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+		now := func() time.Time { return clock }
+		yield := metricsYield(metrics, "gpt-4", now, pass)
+
+		clock = clock.Add(time.Second)
+		yield(textResponse("Hel", true), nil)
+		clock = clock.Add(500 * time.Millisecond)
+		yield(&model.LLMResponse{
+			TurnComplete:  true,
+			UsageMetadata: &genai.GenerateContentResponseUsageMetadata{PromptTokenCount: 10, CandidatesTokenCount: 4},
+		}, nil)
+
+		if want := map[string][]time.Duration{"gpt-4": {1500 * time.Millisecond}}; !reflect.DeepEqual(metrics.latencies, want) {
+			t.Errorf("expected latencies %v, got %v", want, metrics.latencies)
+		}
+		if metrics.prompt != 10 || metrics.output != 4 {
+			t.Errorf("unexpected tokens prompt=%d completion=%d", metrics.prompt, metrics.output)
+		}
+		if len(metrics.errors) != 0 {
+			t.Errorf("expected no errors, got %v", metrics.errors)
+		}
+	})
+
+	t.Run("classifies errors", func(t *testing.T) {
+		metrics := &recordingMetrics{}
+		yield := metricsYield(metrics, "gpt-4", time.Now, pass)
+
+		yield(nil, fmt.Errorf("no stream activity for 1s: %w", context.DeadlineExceeded))
+		yield(nil, context.Canceled)
+		yield(nil, errors.New("session failed"))
+		// Already counted by the tool handler
+		yield(nil, &toolError{name: "divide", err: context.DeadlineExceeded})
+
+		if want := []string{"timeout", "canceled", "request"}; !reflect.DeepEqual(metrics.errors, want) {
+			t.Errorf("expected errors %v, got %v", want, metrics.errors)
+		}
+		if len(metrics.latencies) != 0 {
+			t.Errorf("expected no latency for failed requests, got %v", metrics.latencies)
 		}
 	})
 }